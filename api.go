@@ -0,0 +1,216 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// openAPIDocument describes the API served under /api/v1
+//
+//go:embed openapi.yaml
+var openAPIDocument []byte
+
+// apiDevice is a polled device in the API
+type apiDevice struct {
+	SerialNumber string            `json:"serialno"`
+	Name         string            `json:"name,omitempty"`
+	MachineType  string            `json:"machine_type,omitempty"`
+	Protocol     string            `json:"protocol,omitempty"`
+	Online       *bool             `json:"online,omitempty"`
+	Labels       map[string]string `json:"labels,omitempty"`
+	Sampled      *time.Time        `json:"sampled,omitempty"`
+	Retrieved    *time.Time        `json:"retrieved,omitempty"`
+	AgeSeconds   *float64          `json:"age_seconds,omitempty"`
+}
+
+// apiSample is a work info in the API, with the readings by field name, see workInfoFields
+type apiSample struct {
+	Sampled   time.Time      `json:"sampled"`
+	Retrieved time.Time      `json:"retrieved"`
+	WorkInfo  map[string]any `json:"workinfo"`
+}
+
+// apiWorkInfo is the latest work info of a device in the API
+type apiWorkInfo struct {
+	SerialNumber string `json:"serialno"`
+	apiSample
+	// AgeSeconds is the time since the work info was sampled
+	AgeSeconds float64 `json:"age_seconds"`
+}
+
+// Returns the sample in the API format.
+func newAPISample(s sample) apiSample {
+	wi := map[string]any{}
+
+	for _, f := range workInfoFields(&s.WorkInfo) {
+		wi[f.Name] = f.Value
+	}
+
+	return apiSample{
+		Sampled:   s.Sampled,
+		Retrieved: s.Retrieved,
+		WorkInfo:  wi,
+	}
+}
+
+// Writes the value as JSON response.
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Warnln("Error writing API response:", err)
+	}
+}
+
+// Returns the device of the serial path parameter, or writes a not found response and returns nil.
+func (e *exporter) apiDevice(w http.ResponseWriter, r *http.Request) *device {
+	serial := httprouter.ParamsFromContext(r.Context()).ByName("serial")
+
+	d := e.device(serial)
+	if d == nil {
+		http.Error(w, "unknown device "+serial, http.StatusNotFound)
+	}
+
+	return d
+}
+
+// Serves the polled devices.
+func (e *exporter) apiDevices(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+
+	e.mu.RLock()
+
+	devices := make([]apiDevice, 0, len(e.Devices))
+
+	for _, d := range e.Devices {
+		ad := apiDevice{
+			SerialNumber: d.SerialNumber,
+			Name:         d.Name,
+			MachineType:  d.machineType(),
+			Protocol:     d.Protocol,
+		}
+
+		if e.Discover {
+			online := d.Online
+			ad.Online = &online
+		}
+
+		for i, n := range extraLabels {
+			if v := d.LabelValues[i+1]; v != "" {
+				if ad.Labels == nil {
+					ad.Labels = map[string]string{}
+				}
+
+				ad.Labels[n] = v
+			}
+		}
+
+		if !d.Retrieved.IsZero() {
+			sampled, retrieved := d.sampleTime(), d.Retrieved
+			age := now.Sub(sampled).Seconds()
+
+			ad.Sampled, ad.Retrieved, ad.AgeSeconds = &sampled, &retrieved, &age
+		}
+
+		devices = append(devices, ad)
+	}
+
+	e.mu.RUnlock()
+
+	writeJSON(w, devices)
+}
+
+// Serves the latest work info of a device.
+func (e *exporter) apiWorkInfo(w http.ResponseWriter, r *http.Request) {
+	d := e.apiDevice(w, r)
+	if d == nil {
+		return
+	}
+
+	e.mu.RLock()
+	retrieved := !d.Retrieved.IsZero()
+	wi := newAPIWorkInfo(d)
+	e.mu.RUnlock()
+
+	if !retrieved {
+		http.Error(w, "no work info retrieved yet for "+d.SerialNumber, http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, wi)
+}
+
+// Returns the latest work info of the device in the API format.
+func newAPIWorkInfo(d *device) apiWorkInfo {
+	s := sample{Sampled: d.sampleTime(), Retrieved: d.Retrieved, WorkInfo: d.WorkInfo}
+
+	return apiWorkInfo{
+		SerialNumber: d.SerialNumber,
+		apiSample:    newAPISample(s),
+		AgeSeconds:   time.Since(s.Sampled).Seconds(),
+	}
+}
+
+// Serves the recent samples of a device, oldest first. The optional since parameter is
+// an RFC 3339 time, a Unix time or a duration before now, e.g. 1h, and defaults to all samples.
+func (e *exporter) apiHistory(w http.ResponseWriter, r *http.Request) {
+	d := e.apiDevice(w, r)
+	if d == nil {
+		return
+	}
+
+	var since time.Time
+
+	if s := r.URL.Query().Get("since"); s != "" {
+		var err error
+
+		since, err = parseSince(s, time.Now())
+		if err != nil {
+			http.Error(w, "invalid since "+s, http.StatusBadRequest)
+			return
+		}
+	}
+
+	e.mu.RLock()
+	history := d.History.since(since)
+	e.mu.RUnlock()
+
+	samples := make([]apiSample, 0, len(history))
+
+	for _, s := range history {
+		samples = append(samples, newAPISample(s))
+	}
+
+	writeJSON(w, samples)
+}
+
+// Parses an RFC 3339 time, a Unix time in seconds or a duration before now.
+func parseSince(s string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return now.Add(-d), nil
+}
+
+// Serves the OpenAPI document of the API.
+func serveOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(openAPIDocument)
+}
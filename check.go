@@ -0,0 +1,294 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/marevers/power-datacenter-exporter/pkg/pdc"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Exit codes of the check subcommand as defined by the monitoring plugin guidelines
+const (
+	CheckOK = iota
+	CheckWarning
+	CheckCritical
+	CheckUnknown
+)
+
+var checkStatusNames = []string{"OK", "WARNING", "CRITICAL", "UNKNOWN"}
+
+// checkSeverity ranks the statuses, so an unknown value does not hide a warning or critical one
+var checkSeverity = []int{CheckOK: 0, CheckUnknown: 1, CheckWarning: 2, CheckCritical: 3}
+
+// checkRange is a threshold range in the monitoring plugin format, e.g. "10", "10:", "~:10", "10:20" or "@10:20"
+type checkRange struct {
+	Raw    string
+	Start  float64
+	End    float64
+	Inside bool
+}
+
+// Parses a threshold range, an empty string returns nil.
+func parseCheckRange(s string) (*checkRange, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	r := &checkRange{Raw: s, Start: 0, End: math.Inf(1)}
+
+	v := s
+	if strings.HasPrefix(v, "@") {
+		r.Inside = true
+		v = v[1:]
+	}
+
+	start, end, found := strings.Cut(v, ":")
+	if !found {
+		start, end = "", start
+	}
+
+	var err error
+
+	switch start {
+	case "":
+	case "~":
+		r.Start = math.Inf(-1)
+	default:
+		if r.Start, err = strconv.ParseFloat(start, 64); err != nil {
+			return nil, fmt.Errorf("invalid range %q", s)
+		}
+	}
+
+	if end != "" {
+		if r.End, err = strconv.ParseFloat(end, 64); err != nil {
+			return nil, fmt.Errorf("invalid range %q", s)
+		}
+	}
+
+	if r.Start > r.End {
+		return nil, fmt.Errorf("invalid range %q: start is greater than end", s)
+	}
+
+	return r, nil
+}
+
+// Returns true if the value should raise an alert.
+func (r *checkRange) alert(v float64) bool {
+	if r == nil {
+		return false
+	}
+
+	inside := v >= r.Start && v <= r.End
+
+	return inside == r.Inside
+}
+
+func (r *checkRange) String() string {
+	if r == nil {
+		return ""
+	}
+
+	return r.Raw
+}
+
+// checkThreshold is a value checked against a warning and critical range
+type checkThreshold struct {
+	Name     string
+	Warning  *checkRange
+	Critical *checkRange
+}
+
+// Returns the status of the value.
+func (t checkThreshold) status(v float64) int {
+	switch {
+	case t.Critical.alert(v):
+		return CheckCritical
+	case t.Warning.alert(v):
+		return CheckWarning
+	default:
+		return CheckOK
+	}
+}
+
+// checkResult collects the status, messages and performance data of a check
+type checkResult struct {
+	Status   int
+	Problems []string
+	Summary  []string
+	Perfdata []string
+}
+
+// Raises the status of the result to s, adding the message as problem.
+func (c *checkResult) raise(s int, msg string) {
+	if s == CheckOK {
+		return
+	}
+
+	if checkSeverity[s] > checkSeverity[c.Status] {
+		c.Status = s
+	}
+
+	c.Problems = append(c.Problems, msg)
+}
+
+// Checks the value against the threshold and adds it to the performance data.
+func (c *checkResult) check(t checkThreshold, v float64, unit, label, lo, hi string) {
+	s := t.status(v)
+	c.raise(s, fmt.Sprintf("%s %s (%s)", label, formatCheckValue(v, unit), strings.ToLower(checkStatusNames[s])))
+	c.Summary = append(c.Summary, fmt.Sprintf("%s %s", label, formatCheckValue(v, unit)))
+	c.perfdata(t.Name, v, unit, t.Warning.String(), t.Critical.String(), lo, hi)
+}
+
+// Adds a value to the performance data.
+func (c *checkResult) perfdata(name string, v float64, unit, warn, crit, lo, hi string) {
+	pd := fmt.Sprintf("%s=%s%s;%s;%s;%s;%s", name, strconv.FormatFloat(v, 'f', -1, 64), unit, warn, crit, lo, hi)
+	c.Perfdata = append(c.Perfdata, strings.TrimRight(pd, ";"))
+}
+
+// Writes the result in the plugin output format.
+func (c *checkResult) write(w io.Writer, serial string) {
+	text := strings.Join(c.Summary, ", ")
+	if len(c.Problems) > 0 {
+		text = strings.Join(c.Problems, ", ")
+	}
+
+	fmt.Fprintf(w, "PDC %s - %s: %s", checkStatusNames[c.Status], serial, text)
+
+	if len(c.Perfdata) > 0 {
+		fmt.Fprintf(w, " | %s", strings.Join(c.Perfdata, " "))
+	}
+
+	fmt.Fprintln(w)
+}
+
+func formatCheckValue(v float64, unit string) string {
+	return strconv.FormatFloat(v, 'f', -1, 64) + unit
+}
+
+// Runs the check subcommand with the given arguments and returns the exit code.
+func runCheck(args []string) int {
+	fs := flag.NewFlagSet("check", flag.ContinueOnError)
+
+	// The portal flags are shared with the exporter
+	flag.CommandLine.VisitAll(func(f *flag.Flag) {
+		if strings.HasPrefix(f.Name, "pdc.") || f.Name == "log.level" {
+			fs.Var(f.Value, f.Name, f.Usage)
+		}
+	})
+
+	var (
+		batteryWarning   = fs.String("battery.warning", "", "Warning range of the battery capacity in percent, e.g. '30:' to warn below 30%.")
+		batteryCritical  = fs.String("battery.critical", "", "Critical range of the battery capacity in percent, e.g. '20:' for critical below 20%.")
+		loadWarning      = fs.String("load.warning", "", "Warning range of the total output load in percent, e.g. '80' to warn above 80%.")
+		loadCritical     = fs.String("load.critical", "", "Critical range of the total output load in percent, e.g. '95' for critical above 95%.")
+		ageWarning       = fs.String("age.warning", "", "Warning range of the sample age in seconds, e.g. '900' to warn if the data is older than 15 minutes.")
+		ageCritical      = fs.String("age.critical", "", "Critical range of the sample age in seconds.")
+		gridLost         = fs.String("grid-lost", "critical", "Status if the grid is lost, 'ok', 'warning' or 'critical'.")
+		gridLostStatuses = map[string]int{"ok": CheckOK, "warning": CheckWarning, "critical": CheckCritical}
+	)
+
+	// Plugin output goes to stdout, so only errors are logged unless requested otherwise
+	*logLevel = "error"
+
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return CheckUnknown
+		}
+
+		fmt.Println("PDC UNKNOWN -", err)
+		return CheckUnknown
+	}
+
+	unknown := func(err error) int {
+		fmt.Println("PDC UNKNOWN -", err)
+		return CheckUnknown
+	}
+
+	if level, err := log.ParseLevel(*logLevel); err != nil {
+		return unknown(err)
+	} else {
+		log.SetLevel(level)
+	}
+
+	if *serialNumber == "" {
+		return unknown(errors.New("no serial number set"))
+	}
+
+	gridLostStatus, ok := gridLostStatuses[*gridLost]
+	if !ok {
+		return unknown(fmt.Errorf("invalid grid lost status %q", *gridLost))
+	}
+
+	thresholds := map[string]*checkThreshold{}
+
+	for _, t := range []struct {
+		name, warning, critical string
+	}{
+		{"battery_capacity", *batteryWarning, *batteryCritical},
+		{"load", *loadWarning, *loadCritical},
+		{"sample_age", *ageWarning, *ageCritical},
+	} {
+		warning, err := parseCheckRange(t.warning)
+		if err != nil {
+			return unknown(err)
+		}
+
+		critical, err := parseCheckRange(t.critical)
+		if err != nil {
+			return unknown(err)
+		}
+
+		thresholds[t.name] = &checkThreshold{Name: t.name, Warning: warning, Critical: critical}
+	}
+
+	ses := pdc.NewSession(*baseUrl, *serialNumber)
+
+	if err := ses.Login(*username, *password); err != nil {
+		return unknown(err)
+	}
+
+	d := pdc.Device{SerialNumber: *serialNumber, Protocol: *protocol}
+
+	wi, err := ses.GetDeviceWorkInfo(&d)
+	if err != nil {
+		return unknown(err)
+	}
+
+	var res checkResult
+
+	res.check(*thresholds["battery_capacity"], wi.BatCapacity, "%", "battery", "0", "100")
+	res.check(*thresholds["load"], wi.TotalOutputLoadPercent, "%", "load", "0", "")
+
+	if t := wi.SampleTime(); !t.IsZero() {
+		age := max(time.Since(t).Round(time.Second), 0)
+		res.check(*thresholds["sample_age"], age.Seconds(), "s", "sample age", "0", "")
+	} else if thresholds["sample_age"].Warning != nil || thresholds["sample_age"].Critical != nil {
+		res.raise(CheckUnknown, "sample time not reported")
+	}
+
+	if wi.LineLoss1 || wi.LineLoss2 {
+		res.raise(gridLostStatus, "grid lost")
+		res.Summary = append(res.Summary, "grid lost")
+	}
+
+	if wi.WorkMode != "" {
+		res.Summary = append(res.Summary, wi.WorkMode)
+	}
+
+	res.perfdata("battery_voltage", wi.BatVoltage, "", "", "", "", "")
+	res.perfdata("pv_input_power", wi.TotalPvInputPower, "", "", "", "0", "")
+	res.perfdata("ac_output_active_power", wi.TotalAcOutputActivePower, "", "", "", "0", "")
+
+	res.write(os.Stdout, *serialNumber)
+
+	return res.Status
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseCheckRange(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    *checkRange
+		wantErr bool
+	}{
+		{s: "", want: nil},
+		{s: "10", want: &checkRange{Raw: "10", Start: 0, End: 10}},
+		{s: "10:", want: &checkRange{Raw: "10:", Start: 10, End: math.Inf(1)}},
+		{s: "~:10", want: &checkRange{Raw: "~:10", Start: math.Inf(-1), End: 10}},
+		{s: "10:20", want: &checkRange{Raw: "10:20", Start: 10, End: 20}},
+		{s: "@10:20", want: &checkRange{Raw: "@10:20", Start: 10, End: 20, Inside: true}},
+		{s: "-5:5.5", want: &checkRange{Raw: "-5:5.5", Start: -5, End: 5.5}},
+		{s: "abc", wantErr: true},
+		{s: "1:x", wantErr: true},
+		{s: "20:10", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			got, err := parseCheckRange(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseCheckRange() error = %v, want error %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				return
+			}
+
+			if (got == nil) != (tt.want == nil) || got != nil && *got != *tt.want {
+				t.Errorf("parseCheckRange() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckRangeAlert(t *testing.T) {
+	tests := []struct {
+		r    string
+		v    float64
+		want bool
+	}{
+		{"", 100, false},
+		{"10", -1, true},
+		{"10", 0, false},
+		{"10", 10, false},
+		{"10", 10.1, true},
+		{"10:", 9, true},
+		{"10:", 1000, false},
+		{"~:10", -1000, false},
+		{"~:10", 11, true},
+		{"10:20", 15, false},
+		{"10:20", 25, true},
+		{"@10:20", 15, true},
+		{"@10:20", 20, true},
+		{"@10:20", 25, false},
+	}
+
+	for _, tt := range tests {
+		r, err := parseCheckRange(tt.r)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := r.alert(tt.v); got != tt.want {
+			t.Errorf("range %q alert(%v) = %v, want %v", tt.r, tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestCheckResultRaise(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		want     int
+	}{
+		{"none", nil, CheckOK},
+		{"ok", []int{CheckOK}, CheckOK},
+		{"warning", []int{CheckOK, CheckWarning}, CheckWarning},
+		{"critical over warning", []int{CheckWarning, CheckCritical, CheckWarning}, CheckCritical},
+		{"unknown", []int{CheckUnknown}, CheckUnknown},
+		{"critical over unknown", []int{CheckCritical, CheckUnknown}, CheckCritical},
+		{"critical after unknown", []int{CheckUnknown, CheckCritical}, CheckCritical},
+		{"warning over unknown", []int{CheckUnknown, CheckWarning}, CheckWarning},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c checkResult
+
+			problems := 0
+
+			for _, s := range tt.statuses {
+				c.raise(s, checkStatusNames[s])
+
+				if s != CheckOK {
+					problems++
+				}
+			}
+
+			if c.Status != tt.want {
+				t.Errorf("status = %s, want %s", checkStatusNames[c.Status], checkStatusNames[tt.want])
+			}
+
+			if len(c.Problems) != problems {
+				t.Errorf("problems = %v, want %d", c.Problems, problems)
+			}
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+
+	"gopkg.in/yaml.v3"
+)
+
+var labelNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Labels that are set by the exporter itself and cannot be configured
+var reservedLabels = []string{
+	LabelSerialNumber,
+	LabelSource,
+	LabelWorkMode,
+	LabelMachineType,
+	LabelProtocol,
+	LabelDeviceName,
+	LabelLine,
+	LabelString,
+	LabelOutput,
+	LabelFrom,
+	LabelTo,
+}
+
+// config is the optional configuration file
+type config struct {
+	// Labels are added to the metrics of every device
+	Labels  map[string]string `yaml:"labels"`
+	Devices []deviceConfig    `yaml:"devices"`
+	// Aliases map portal strings to normalized values per named status,
+	// i.e. work_mode, charge_source or load_source
+	Aliases map[string]map[string]string `yaml:"aliases"`
+}
+
+// deviceConfig holds the settings of a single device
+type deviceConfig struct {
+	SerialNumber string `yaml:"serialnumber"`
+	// Name is the friendly name of the device, added as name label
+	Name     string `yaml:"name"`
+	Protocol string `yaml:"protocol"`
+	// Labels are added to the metrics of the device, overriding global labels
+	Labels map[string]string `yaml:"labels"`
+}
+
+// Reads and validates the configuration file at the given path.
+func loadConfig(path string) (*config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &config{}
+
+	if err := yaml.Unmarshal(b, cfg); err != nil {
+		return nil, fmt.Errorf("error parsing config file %v: %w", path, err)
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("error in config file %v: %w", path, err)
+	}
+
+	return cfg, nil
+}
+
+func (c *config) validate() error {
+	if err := validateLabels(c.Labels); err != nil {
+		return err
+	}
+
+	for kind, aliases := range c.Aliases {
+		if enumKindByName(kind) == nil {
+			return fmt.Errorf("aliases for unknown status %q", kind)
+		}
+
+		for raw, v := range aliases {
+			if !snakeCaseRegexp.MatchString(v) {
+				return fmt.Errorf("alias %q of %v is not in snake case: %q", raw, kind, v)
+			}
+		}
+	}
+
+	serials := map[string]bool{}
+
+	for _, d := range c.Devices {
+		if d.SerialNumber == "" {
+			return fmt.Errorf("device without serialnumber")
+		}
+
+		if serials[d.SerialNumber] {
+			return fmt.Errorf("duplicate device %v", d.SerialNumber)
+		}
+
+		serials[d.SerialNumber] = true
+
+		if err := validateLabels(d.Labels); err != nil {
+			return fmt.Errorf("device %v: %w", d.SerialNumber, err)
+		}
+	}
+
+	return nil
+}
+
+func validateLabels(l map[string]string) error {
+	for name := range l {
+		if !labelNameRegexp.MatchString(name) || len(name) > 1 && name[:2] == "__" {
+			return fmt.Errorf("invalid label name %q", name)
+		}
+
+		if slices.Contains(reservedLabels, name) {
+			return fmt.Errorf("label name %q is reserved", name)
+		}
+	}
+
+	return nil
+}
+
+// Returns the sorted names of all configured labels,
+// including the name label if any device has a friendly name.
+func (c *config) labelNames() []string {
+	var names []string
+
+	add := func(n string) {
+		if !slices.Contains(names, n) {
+			names = append(names, n)
+		}
+	}
+
+	for n := range c.Labels {
+		add(n)
+	}
+
+	for _, d := range c.Devices {
+		for n := range d.Labels {
+			add(n)
+		}
+
+		if d.Name != "" {
+			add(LabelDeviceName)
+		}
+	}
+
+	slices.Sort(names)
+
+	return names
+}
+
+// Returns the configuration of the device with the given serial number, or nil.
+func (c *config) device(serial string) *deviceConfig {
+	for i := range c.Devices {
+		if c.Devices[i].SerialNumber == serial {
+			return &c.Devices[i]
+		}
+	}
+
+	return nil
+}
+
+// Returns the values of the given label names for the device with the given serial number.
+func (c *config) labelValues(serial string, names []string) []string {
+	dc := c.device(serial)
+
+	values := make([]string, 0, len(names))
+
+	for _, n := range names {
+		v := c.Labels[n]
+
+		if dc != nil {
+			if dv, ok := dc.Labels[n]; ok {
+				v = dv
+			} else if n == LabelDeviceName {
+				v = dc.Name
+			}
+		}
+
+		values = append(values, v)
+	}
+
+	return values
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"embed"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// webFS holds the dashboard page and its assets
+//
+//go:embed web
+var webFS embed.FS
+
+var dashboardTemplate = template.Must(template.ParseFS(webFS, "web/index.html"))
+
+// Serves the dashboard, which renders the readings of the API in the browser.
+func (e *exporter) dashboard(w http.ResponseWriter, r *http.Request) {
+	data := struct {
+		MetricsPath string
+		Stream      bool
+	}{
+		MetricsPath: *metricsPath,
+		Stream:      e.Stream != nil,
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	if err := dashboardTemplate.Execute(w, data); err != nil {
+		log.Warnln("Error writing dashboard:", err)
+	}
+}
+
+// Returns a handler serving the scripts and styles of the dashboard under /assets/.
+// Directories are not listed.
+func dashboardAssets() http.Handler {
+	assets, err := fs.Sub(webFS, "web/assets")
+	if err != nil {
+		panic(err)
+	}
+
+	h := http.StripPrefix("/assets/", http.FileServerFS(assets))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/") {
+			http.NotFound(w, r)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
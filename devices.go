@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"github.com/marevers/power-datacenter-exporter/pkg/pdc"
+	"github.com/prometheus/client_golang/prometheus"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// device is a polled inverter together with its latest work info
+type device struct {
+	pdc.Device
+	WorkInfo pdc.WorkInfo
+	// LabelValues are the values of the labels that come with every metric of the device
+	LabelValues []string
+	// Retrieved is the time the latest work info was retrieved
+	Retrieved time.Time
+	// History holds the most recent samples
+	History history
+	// Schedule is only used by the polling goroutine
+	Schedule schedule
+}
+
+// Returns a new device with the settings from the configuration file applied.
+func (e *exporter) newDevice(pd pdc.Device) *device {
+	if dc := e.Config.device(pd.SerialNumber); dc != nil {
+		if dc.Name != "" {
+			pd.Name = dc.Name
+		}
+
+		if dc.Protocol != "" {
+			pd.Protocol = dc.Protocol
+		}
+	}
+
+	if pd.Protocol == "" {
+		pd.Protocol = *protocol
+	}
+
+	lv := append([]string{pd.SerialNumber}, e.Config.labelValues(pd.SerialNumber, extraLabels)...)
+
+	return &device{
+		Device:      pd,
+		LabelValues: slices.Clip(lv),
+	}
+}
+
+// Returns the devices from the configuration file and the serial number flag.
+func (e *exporter) configuredDevices() []*device {
+	var devices []*device
+
+	for _, dc := range e.Config.Devices {
+		devices = append(devices, e.newDevice(pdc.Device{SerialNumber: dc.SerialNumber}))
+	}
+
+	if *serialNumber != "" && e.Config.device(*serialNumber) == nil {
+		devices = append(devices, e.newDevice(pdc.Device{SerialNumber: *serialNumber}))
+	}
+
+	return devices
+}
+
+// Returns the time the latest work info was sampled on the device, or the current time
+// if the device did not report it. Times in the future due to clock skew are capped at the current time.
+func (d *device) sampleTime() time.Time {
+	now := time.Now()
+
+	t := d.WorkInfo.SampleTime()
+	if t.IsZero() || t.After(now) {
+		return now
+	}
+
+	return t
+}
+
+// Returns the machine type reported by the portal,
+// falling back to the one from the latest work info.
+func (d *device) machineType() string {
+	if d.MachineType != "" {
+		return d.MachineType
+	}
+
+	return d.WorkInfo.MachineType
+}
+
+// Returns the device with the given serial number, or nil if it is not polled.
+func (e *exporter) device(serial string) *device {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	for _, d := range e.Devices {
+		if d.SerialNumber == serial {
+			return d
+		}
+	}
+
+	return nil
+}
+
+// Refreshes the list of polled devices from the devices attached to the account.
+// Devices that are already known keep their state, devices that are no longer
+// attached are removed together with their metrics.
+func (e *exporter) discoverDevices(ctx context.Context) error {
+	list, err := e.Session.ListDevicesContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+
+	e.LastDiscovery = time.Now()
+
+	known := make(map[string]*device, len(e.Devices))
+	for _, d := range e.Devices {
+		known[d.SerialNumber] = d
+	}
+
+	devices := make([]*device, 0, len(list))
+
+	for _, ld := range list {
+		if d, ok := known[ld.SerialNumber]; ok {
+			if dc := e.Config.device(ld.SerialNumber); dc == nil || dc.Name == "" {
+				d.Name = ld.Name
+			}
+
+			d.MachineType = ld.MachineType
+			d.Online = ld.Online
+
+			delete(known, ld.SerialNumber)
+			devices = append(devices, d)
+
+			continue
+		}
+
+		d := e.newDevice(ld)
+
+		log.WithContext(ctx).Infoln("Discovered device", d.SerialNumber, d.Name)
+
+		devices = append(devices, d)
+	}
+
+	for serial := range known {
+		log.WithContext(ctx).Infoln("Device", serial, "is no longer attached to the account")
+
+		e.deleteDeviceMetrics(serial)
+		delete(e.State.Devices, serial)
+	}
+
+	e.Devices = devices
+
+	e.mu.Unlock()
+
+	// Publishers may read the devices while releasing their state
+	for serial := range known {
+		e.removeFromPublishers(serial)
+	}
+
+	return nil
+}
+
+// Deletes all metrics of the device with the given serial number.
+func (e *exporter) deleteDeviceMetrics(serial string) {
+	l := prometheus.Labels{LabelSerialNumber: serial}
+
+	for _, v := range e.deviceVecs() {
+		v.DeletePartialMatch(l)
+	}
+}
+
+func (e *exporter) deviceVecs() []*prometheus.GaugeVec {
+	vecs := []*prometheus.GaugeVec{
+		e.Metrics.ChargeSourceVec,
+		e.Metrics.LoadSourceVec,
+		e.Metrics.WorkModeVec,
+		e.Metrics.DeviceInfoVec,
+		e.Metrics.DeviceOnlineVec,
+		e.Metrics.RefreshIntervalVec,
+	}
+
+	for _, g := range e.Metrics.Gauges {
+		vecs = append(vecs, g.Vec)
+	}
+
+	return vecs
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/marevers/power-datacenter-exporter/pkg/pdc"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// ValueOther is the normalized value of unknown portal strings
+	ValueOther = "other"
+)
+
+var (
+	nonAlphanumericRegexp = regexp.MustCompile(`[^a-z0-9]+`)
+	snakeCaseRegexp       = regexp.MustCompile(`^[a-z0-9]+(_[a-z0-9]+)*$`)
+)
+
+// enumKind is a named status of the work info with a registry of its known values
+type enumKind struct {
+	Name        string
+	Description string
+	Label       string
+	// Known are the normalized values that are always part of the state set
+	Known []string
+	// Suffix is removed from normalized values, e.g. "_mode" turns "Line Mode" into line
+	Suffix string
+	Value  func(wi *pdc.WorkInfo) string
+}
+
+var enumKinds = []enumKind{
+	{
+		Name: "work_mode", Description: "work mode", Label: LabelWorkMode,
+		Known:  []string{"power_on", "standby", "line", "battery", "fault", "power_saving", "shutdown"},
+		Suffix: "_mode",
+		Value:  func(wi *pdc.WorkInfo) string { return wi.WorkMode },
+	},
+	{
+		Name: "charge_source", Description: "charge source", Label: LabelSource,
+		Known: []string{"none", "pv", "utility", "pv_and_utility"},
+		Value: func(wi *pdc.WorkInfo) string { return wi.ChargeSource },
+	},
+	{
+		Name: "load_source", Description: "load source", Label: LabelSource,
+		Known: []string{"pv", "utility", "battery", "pv_and_battery", "pv_and_utility"},
+		Value: func(wi *pdc.WorkInfo) string { return wi.LoadSource },
+	},
+}
+
+// Returns the enum kind with the given name, or nil.
+func enumKindByName(name string) *enumKind {
+	for i := range enumKinds {
+		if enumKinds[i].Name == name {
+			return &enumKinds[i]
+		}
+	}
+
+	return nil
+}
+
+// Converts a portal string to snake case, e.g. "PV and Utility" to pv_and_utility.
+func toSnakeCase(s string) string {
+	return strings.Trim(nonAlphanumericRegexp.ReplaceAllString(strings.ToLower(s), "_"), "_")
+}
+
+// Returns the normalized value of a portal string. Configured aliases take precedence,
+// otherwise the snake case of the string is used if it is a known value and other if not.
+func (c *config) normalize(k enumKind, raw string) string {
+	if v, ok := c.Aliases[k.Name][raw]; ok {
+		return v
+	}
+
+	v := strings.TrimSuffix(toSnakeCase(raw), k.Suffix)
+
+	if slices.Contains(c.knownValues(k), v) {
+		return v
+	}
+
+	return ValueOther
+}
+
+// Returns the known values of the enum kind including configured alias targets and other.
+func (c *config) knownValues(k enumKind) []string {
+	values := slices.Clone(k.Known)
+
+	for _, v := range c.Aliases[k.Name] {
+		if !slices.Contains(values, v) {
+			values = append(values, v)
+		}
+	}
+
+	return append(values, ValueOther)
+}
+
+// Sets the gauge of a named status of the device. With state sets enabled, a series is set
+// for every known value, 1 for the normalized current value and 0 for all others.
+// Otherwise a single series with the portal string is set to 1.
+func (e *exporter) setEnum(vec *prometheus.GaugeVec, kind string, d *device) {
+	k := enumKindByName(kind)
+	raw := k.Value(&d.WorkInfo)
+
+	if !*statesets {
+		vec.DeletePartialMatch(prometheus.Labels{LabelSerialNumber: d.SerialNumber})
+		vec.WithLabelValues(append(d.LabelValues, raw)...).Set(1)
+
+		return
+	}
+
+	current := e.Config.normalize(*k, raw)
+
+	for _, v := range e.Config.knownValues(*k) {
+		vec.WithLabelValues(append(d.LabelValues, v)...).Set(convertBoolToFloat(v == current))
+	}
+}
@@ -1,12 +1,20 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
 	"time"
 
 	"github.com/marevers/power-datacenter-exporter/pkg/pdc"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -21,8 +29,20 @@ const (
 	//LabelWorkMode represents work mode
 	LabelWorkMode = "mode"
 
+	// LabelMachineType represents the inverter machine type
+	LabelMachineType = "machine_type"
+
+	// LabelProtocol represents the protocol ID used to retrieve data
+	LabelProtocol = "protocol"
+
+	// LabelDeviceName represents the friendly name of the device
+	LabelDeviceName = "name"
+
 	// Namespace is the metrics prefix
 	Namespace = "pdc"
+
+	// Minimum time between logins when retrieving work info fails
+	minReloginInterval = 5 * time.Minute
 )
 
 var (
@@ -40,59 +60,51 @@ var (
 		LabelSerialNumber,
 		LabelWorkMode,
 	}
+
+	labelsDeviceInfo = []string{
+		LabelSerialNumber,
+		LabelMachineType,
+		LabelProtocol,
+	}
+
+	// Names of the configured extra labels, which follow the serial number
+	extraLabels []string
 )
 
+// Adds the configured extra labels to all label sets.
+func setExtraLabels(names []string) {
+	extraLabels = names
+
+	labels = append([]string{LabelSerialNumber}, names...)
+	labelsSource = append(slices.Clone(labels), LabelSource)
+	labelsWorkMode = append(slices.Clone(labels), LabelWorkMode)
+	labelsDeviceInfo = append(slices.Clone(labels), LabelMachineType, LabelProtocol)
+}
+
 type exporter struct {
-	Reg     *prometheus.Registry
-	Session *pdc.Session
-	Metrics struct {
-		GridFrequency1Vec *prometheus.GaugeVec
-		GridFrequency2Vec *prometheus.GaugeVec
-		GridVoltage1Vec   *prometheus.GaugeVec
-		GridVoltage2Vec   *prometheus.GaugeVec
-
-		PvInputVoltage1Vec *prometheus.GaugeVec
-		PvInputVoltage2Vec *prometheus.GaugeVec
-		PvInputCurrent1Vec *prometheus.GaugeVec
-		PvInputCurrent2Vec *prometheus.GaugeVec
-
-		AcOutputVoltage1Vec       *prometheus.GaugeVec
-		AcOutputVoltage2Vec       *prometheus.GaugeVec
-		AcOutputFrequency1Vec     *prometheus.GaugeVec
-		AcOutputFrequency2Vec     *prometheus.GaugeVec
-		AcOutputApparentPower1Vec *prometheus.GaugeVec
-		AcOutputApparentPower2Vec *prometheus.GaugeVec
-		AcOutputActivePower1Vec   *prometheus.GaugeVec
-		AcOutputActivePower2Vec   *prometheus.GaugeVec
-
-		OutputLoadPercent1Vec *prometheus.GaugeVec
-		OutputLoadPercent2Vec *prometheus.GaugeVec
-
-		BatVoltageVec       *prometheus.GaugeVec
-		BatCapacityVec      *prometheus.GaugeVec
-		BatChgCurrentVec    *prometheus.GaugeVec
-		BatDischgCurrentVec *prometheus.GaugeVec
-
-		TotalPvInputPowerVec          *prometheus.GaugeVec
-		TotalOutputLoadPercentVec     *prometheus.GaugeVec
-		TotalBatChgCurrentVec         *prometheus.GaugeVec
-		TotalAcOutputApparentPowerVec *prometheus.GaugeVec
-		TotalAcOutputActivePowerVec   *prometheus.GaugeVec
+	Reg           *prometheus.Registry
+	Session       *pdc.Session
+	Config        *config
+	State         *state
+	Devices       []*device
+	Discover      bool
+	LastDiscovery time.Time
+	LastLogin     time.Time
+	Publishers    []publisher
+	Stream        *streamBroker
+	Storage       *storagePublisher
+	mu            sync.RWMutex
+	Metrics       struct {
+		Gauges []gauge
 
 		ChargeSourceVec *prometheus.GaugeVec
 		LoadSourceVec   *prometheus.GaugeVec
 		WorkModeVec     *prometheus.GaugeVec
 
-		HasLoad1Vec     *prometheus.GaugeVec
-		HasLoad2Vec     *prometheus.GaugeVec
-		ACChargeOn1Vec  *prometheus.GaugeVec
-		ACChargeOn2Vec  *prometheus.GaugeVec
-		ChargeOnVec     *prometheus.GaugeVec
-		SCCChargeOn1Vec *prometheus.GaugeVec
-		SCCChargeOn2Vec *prometheus.GaugeVec
-		LineLoss1Vec    *prometheus.GaugeVec
-		LineLoss2Vec    *prometheus.GaugeVec
-		OverloadVec     *prometheus.GaugeVec
+		DeviceInfoVec   *prometheus.GaugeVec
+		DeviceOnlineVec *prometheus.GaugeVec
+
+		RefreshIntervalVec *prometheus.GaugeVec
 
 		ScrapeError prometheus.Gauge
 	}
@@ -110,375 +122,264 @@ func createRegistry() *prometheus.Registry {
 }
 
 func (e *exporter) registerMetrics(labels []string) {
-	// Grid
-
-	e.Metrics.GridFrequency1Vec = promauto.With(e.Reg).NewGaugeVec(prometheus.GaugeOpts{
-		Name:      "grid1_frequency",
-		Namespace: Namespace,
-		Help:      "Grid 1 frequency in herz",
-	}, labels)
+	// Metrics set from the work info are exposed with the sample time of the device if enabled
+	var reg prometheus.Registerer = e.Reg
 
-	e.Metrics.GridFrequency2Vec = promauto.With(e.Reg).NewGaugeVec(prometheus.GaugeOpts{
-		Name:      "grid2_frequency",
-		Namespace: Namespace,
-		Help:      "Grid 2 frequency in herz",
-	}, labels)
+	if *timestamps {
+		tc := newTimestampCollector(e)
+		reg = tc
 
-	e.Metrics.GridVoltage1Vec = promauto.With(e.Reg).NewGaugeVec(prometheus.GaugeOpts{
-		Name:      "grid1_voltage",
-		Namespace: Namespace,
-		Help:      "Grid 1 voltage",
-	}, labels)
+		// Register after all metrics were added, so the registry checks their descriptors
+		defer e.Reg.MustRegister(tc)
+	}
 
-	e.Metrics.GridVoltage2Vec = promauto.With(e.Reg).NewGaugeVec(prometheus.GaugeOpts{
-		Name:      "grid2_voltage",
-		Namespace: Namespace,
-		Help:      "Grid 2 voltage",
-	}, labels)
+	var disabled []string
 
-	// PV input
+	if !*powerFactorMetrics {
+		disabled = append(disabled, GroupPowerFactor)
+	}
 
-	e.Metrics.PvInputVoltage1Vec = promauto.With(e.Reg).NewGaugeVec(prometheus.GaugeOpts{
-		Name:      "pvinput1_voltage",
-		Namespace: Namespace,
-		Help:      "PV input 1 voltage",
-	}, labels)
+	e.registerGauges(reg, labels, *naming, *legacyNames, disabled)
 
-	e.Metrics.PvInputVoltage2Vec = promauto.With(e.Reg).NewGaugeVec(prometheus.GaugeOpts{
-		Name:      "pvinput2_voltage",
-		Namespace: Namespace,
-		Help:      "PV input 2 voltage",
-	}, labels)
+	// Charge / Load source
 
-	e.Metrics.PvInputCurrent1Vec = promauto.With(e.Reg).NewGaugeVec(prometheus.GaugeOpts{
-		Name:      "pvinput1_current",
+	e.Metrics.ChargeSourceVec = promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+		Name:      "charge_source",
 		Namespace: Namespace,
-		Help:      "PV input 1 current in amps",
-	}, labels)
+		Help:      "Charge source",
+	}, labelsSource)
 
-	e.Metrics.PvInputCurrent2Vec = promauto.With(e.Reg).NewGaugeVec(prometheus.GaugeOpts{
-		Name:      "pvinput2_current",
+	e.Metrics.LoadSourceVec = promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+		Name:      "load_source",
 		Namespace: Namespace,
-		Help:      "PV input 2 current in amps",
-	}, labels)
-
-	// AC output
+		Help:      "Load source",
+	}, labelsSource)
 
-	e.Metrics.AcOutputVoltage1Vec = promauto.With(e.Reg).NewGaugeVec(prometheus.GaugeOpts{
-		Name:      "acoutput1_voltage",
-		Namespace: Namespace,
-		Help:      "AC output 1 voltage",
-	}, labels)
+	// Work mode
 
-	e.Metrics.AcOutputVoltage2Vec = promauto.With(e.Reg).NewGaugeVec(prometheus.GaugeOpts{
-		Name:      "acoutput2_voltage",
+	e.Metrics.WorkModeVec = promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+		Name:      "work_mode",
 		Namespace: Namespace,
-		Help:      "AC output 2 voltage",
-	}, labels)
+		Help:      "Work mode",
+	}, labelsWorkMode)
 
-	e.Metrics.AcOutputFrequency1Vec = promauto.With(e.Reg).NewGaugeVec(prometheus.GaugeOpts{
-		Name:      "acoutput1_frequency",
-		Namespace: Namespace,
-		Help:      "AC output 1 frequency in herz",
-	}, labels)
+	// Device info
 
-	e.Metrics.AcOutputFrequency2Vec = promauto.With(e.Reg).NewGaugeVec(prometheus.GaugeOpts{
-		Name:      "acoutput2_frequency",
+	e.Metrics.DeviceInfoVec = promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+		Name:      "device_info",
 		Namespace: Namespace,
-		Help:      "AC output 2 frequency in herz",
-	}, labels)
+		Help:      "Device information with the protocol used to retrieve data, always 1",
+	}, labelsDeviceInfo)
 
-	e.Metrics.AcOutputApparentPower1Vec = promauto.With(e.Reg).NewGaugeVec(prometheus.GaugeOpts{
-		Name:      "acoutput1_apparent_power",
+	e.Metrics.DeviceOnlineVec = promauto.With(e.Reg).NewGaugeVec(prometheus.GaugeOpts{
+		Name:      "device_online",
 		Namespace: Namespace,
-		Help:      "AC output 1 apparent power in volt-amps",
+		Help:      "Returns 1 if the device is reported online by the portal, only set for discovered devices",
 	}, labels)
 
-	e.Metrics.AcOutputApparentPower2Vec = promauto.With(e.Reg).NewGaugeVec(prometheus.GaugeOpts{
-		Name:      "acoutput2_apparent_power",
-		Namespace: Namespace,
-		Help:      "AC output 2 apparent power in volt-amps",
-	}, labels)
+	// Portal refresh interval
 
-	e.Metrics.AcOutputActivePower1Vec = promauto.With(e.Reg).NewGaugeVec(prometheus.GaugeOpts{
-		Name:      "acoutput1_active_power",
+	e.Metrics.RefreshIntervalVec = promauto.With(e.Reg).NewGaugeVec(prometheus.GaugeOpts{
+		Name:      "portal_refresh_interval_seconds",
 		Namespace: Namespace,
-		Help:      "AC output 1 active power in watts",
+		Help:      "Detected interval in seconds the portal refreshes the data of the device with",
 	}, labels)
 
-	e.Metrics.AcOutputActivePower2Vec = promauto.With(e.Reg).NewGaugeVec(prometheus.GaugeOpts{
-		Name:      "acoutput2_active_power",
-		Namespace: Namespace,
-		Help:      "AC output 2 active power in watts",
-	}, labels)
+	// Grid outages and state transitions
 
-	// Output load
+	e.Reg.MustRegister(
+		newOutageCollector(e, labels),
+		newTransitionCollector(e, labels),
+	)
 
-	e.Metrics.OutputLoadPercent1Vec = promauto.With(e.Reg).NewGaugeVec(prometheus.GaugeOpts{
-		Name:      "output1_load_percent",
-		Namespace: Namespace,
-		Help:      "Output 1 load in percentage",
-	}, labels)
+	// Scrape error
 
-	e.Metrics.OutputLoadPercent2Vec = promauto.With(e.Reg).NewGaugeVec(prometheus.GaugeOpts{
-		Name:      "output2_load_percent",
+	e.Metrics.ScrapeError = promauto.With(e.Reg).NewGauge(prometheus.GaugeOpts{
+		Name:      "scrape_error",
 		Namespace: Namespace,
-		Help:      "Output 2 load in percentage",
-	}, labels)
+		Help:      "Returns 1 if the last scrape failed",
+	})
+}
 
-	// Battery
+func convertBoolToFloat(b bool) float64 {
+	if b {
+		return 1.0
+	}
 
-	e.Metrics.BatVoltageVec = promauto.With(e.Reg).NewGaugeVec(prometheus.GaugeOpts{
-		Name:      "battery_voltage",
-		Namespace: Namespace,
-		Help:      "Battery voltage",
-	}, labels)
+	return 0.0
+}
 
-	e.Metrics.BatCapacityVec = promauto.With(e.Reg).NewGaugeVec(prometheus.GaugeOpts{
-		Name:      "battery_capacity_percent",
-		Namespace: Namespace,
-		Help:      "Battery capacity in percentage",
-	}, labels)
+func (e *exporter) calculateMetrics() error {
+	return e.pollDevices(func(*device) bool { return true })
+}
 
-	e.Metrics.BatChgCurrentVec = promauto.With(e.Reg).NewGaugeVec(prometheus.GaugeOpts{
-		Name:      "battery_charge_current",
-		Namespace: Namespace,
-		Help:      "Battery charge current in amps",
-	}, labels)
+// Retrieves the work info and calculates the metrics of the devices for which due returns true.
+// Every poll cycle is traced as a single span.
+func (e *exporter) pollDevices(due func(d *device) bool) error {
+	ctx, span := otel.Tracer(otlpScope).Start(context.Background(), "poll")
+	defer span.End()
 
-	e.Metrics.BatDischgCurrentVec = promauto.With(e.Reg).NewGaugeVec(prometheus.GaugeOpts{
-		Name:      "battery_discharge_current",
-		Namespace: Namespace,
-		Help:      "Battery discharge current in amps",
-	}, labels)
+	e.Metrics.ScrapeError.Set(0)
 
-	// Totals
+	if e.Discover && time.Since(e.LastDiscovery) >= time.Duration(*discoveryInterval)*time.Second {
+		if err := e.discoverDevices(ctx); err != nil {
+			log.WithContext(ctx).Warnln("Device discovery failed:", err)
+		}
+	}
 
-	e.Metrics.TotalPvInputPowerVec = promauto.With(e.Reg).NewGaugeVec(prometheus.GaugeOpts{
-		Name:      "total_pvinput_power",
-		Namespace: Namespace,
-		Help:      "Total PV input power in watts",
-	}, labels)
+	var (
+		errs   []error
+		polled int
+	)
 
-	e.Metrics.TotalOutputLoadPercentVec = promauto.With(e.Reg).NewGaugeVec(prometheus.GaugeOpts{
-		Name:      "total_output_load_percent",
-		Namespace: Namespace,
-		Help:      "Total output load in percentage",
-	}, labels)
+	for _, d := range e.Devices {
+		if !due(d) {
+			continue
+		}
 
-	e.Metrics.TotalBatChgCurrentVec = promauto.With(e.Reg).NewGaugeVec(prometheus.GaugeOpts{
-		Name:      "total_battery_charge_current",
-		Namespace: Namespace,
-		Help:      "Total battery charge current in amps",
-	}, labels)
+		polled++
 
-	e.Metrics.TotalAcOutputApparentPowerVec = promauto.With(e.Reg).NewGaugeVec(prometheus.GaugeOpts{
-		Name:      "total_acoutput_apparent_power",
-		Namespace: Namespace,
-		Help:      "Total AC output apparent power in volt-amps",
-	}, labels)
+		if err := e.calculateDeviceMetrics(ctx, d); err != nil {
+			errs = append(errs, err)
+		}
+	}
 
-	e.Metrics.TotalAcOutputActivePowerVec = promauto.With(e.Reg).NewGaugeVec(prometheus.GaugeOpts{
-		Name:      "total_acoutput_active_power",
-		Namespace: Namespace,
-		Help:      "Total AC output active power in watts",
-	}, labels)
+	span.SetAttributes(attribute.Int("pdc.devices", polled))
 
-	// Charge / Load source
+	if len(errs) > 0 {
+		e.Metrics.ScrapeError.Set(1)
 
-	e.Metrics.ChargeSourceVec = promauto.With(e.Reg).NewGaugeVec(prometheus.GaugeOpts{
-		Name:      "charge_source",
-		Namespace: Namespace,
-		Help:      "Charge source",
-	}, labelsSource)
+		span.SetStatus(codes.Error, errors.Join(errs...).Error())
+	}
 
-	e.Metrics.LoadSourceVec = promauto.With(e.Reg).NewGaugeVec(prometheus.GaugeOpts{
-		Name:      "load_source",
-		Namespace: Namespace,
-		Help:      "Load source",
-	}, labelsSource)
+	return errors.Join(errs...)
+}
 
-	// Work mode
+// Logs in again if no login happened recently. Returns true if the session was renewed.
+func (e *exporter) relogin(ctx context.Context) bool {
+	if time.Since(e.LastLogin) < minReloginInterval {
+		return false
+	}
 
-	e.Metrics.WorkModeVec = promauto.With(e.Reg).NewGaugeVec(prometheus.GaugeOpts{
-		Name:      "work_mode",
-		Namespace: Namespace,
-		Help:      "Work mode",
-	}, labelsWorkMode)
+	e.LastLogin = time.Now()
 
-	// Boolean statuses
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Bool(pdc.AttributeRelogin, true))
 
-	e.Metrics.HasLoad1Vec = promauto.With(e.Reg).NewGaugeVec(prometheus.GaugeOpts{
-		Name:      "hasload1",
-		Namespace: Namespace,
-		Help:      "Returns 1 if output 1 has load",
-	}, labels)
+	if err := e.Session.LoginContext(ctx, *username, *password); err != nil {
+		log.WithContext(ctx).Warnln("Error renewing session:", err)
+		return false
+	}
 
-	e.Metrics.HasLoad2Vec = promauto.With(e.Reg).NewGaugeVec(prometheus.GaugeOpts{
-		Name:      "hasload2",
-		Namespace: Namespace,
-		Help:      "Returns 1 if output 2 has load",
-	}, labels)
+	log.WithContext(ctx).Infoln("Renewed session")
 
-	e.Metrics.ACChargeOn1Vec = promauto.With(e.Reg).NewGaugeVec(prometheus.GaugeOpts{
-		Name:      "acchargeon1",
-		Namespace: Namespace,
-		Help:      "Returns 1 if line 1 is being charged with utility power",
-	}, labels)
+	return true
+}
 
-	e.Metrics.ACChargeOn2Vec = promauto.With(e.Reg).NewGaugeVec(prometheus.GaugeOpts{
-		Name:      "acchargeon2",
-		Namespace: Namespace,
-		Help:      "Returns 1 if line 2 is being charged with utility power",
-	}, labels)
+func (e *exporter) calculateDeviceMetrics(ctx context.Context, d *device) error {
+	// Retrieve data on a copy, so the device is only locked while updating it
+	pd := d.Device
 
-	e.Metrics.SCCChargeOn1Vec = promauto.With(e.Reg).NewGaugeVec(prometheus.GaugeOpts{
-		Name:      "sccchargeon1",
-		Namespace: Namespace,
-		Help:      "Returns 1 if line 1 is being charged with solar power",
-	}, labels)
+	delay := time.Duration(*adaptiveDelay) * time.Second
+	maxInterval := time.Duration(*interval) * time.Second
 
-	e.Metrics.SCCChargeOn2Vec = promauto.With(e.Reg).NewGaugeVec(prometheus.GaugeOpts{
-		Name:      "sccchargeon2",
-		Namespace: Namespace,
-		Help:      "Returns 1 if line 2 is being charged with solar power",
-	}, labels)
+	wi, err := e.Session.GetDeviceWorkInfoContext(ctx, &pd)
 
-	e.Metrics.LineLoss1Vec = promauto.With(e.Reg).NewGaugeVec(prometheus.GaugeOpts{
-		Name:      "lineloss1",
-		Namespace: Namespace,
-		Help:      "Returns 1 if utility line 1 is offline",
-	}, labels)
+	// The session may have expired
+	if err != nil && e.relogin(ctx) {
+		wi, err = e.Session.GetDeviceWorkInfoContext(ctx, &pd)
+	}
 
-	e.Metrics.LineLoss2Vec = promauto.With(e.Reg).NewGaugeVec(prometheus.GaugeOpts{
-		Name:      "lineloss2",
-		Namespace: Namespace,
-		Help:      "Returns 1 if utility line 2 is offline",
-	}, labels)
+	if err != nil {
+		d.Schedule.failed(time.Now(), delay, maxInterval)
+		return err
+	}
 
-	e.Metrics.OverloadVec = promauto.With(e.Reg).NewGaugeVec(prometheus.GaugeOpts{
-		Name:      "overload",
-		Namespace: Namespace,
-		Help:      "Returns 1 if system is overloaded",
-	}, labels)
+	now := time.Now()
 
-	// Scrape error
+	isNew := d.Schedule.update(wi.DataID, wi.SampleTime(), now, delay, maxInterval)
 
-	e.Metrics.ScrapeError = promauto.With(e.Reg).NewGauge(prometheus.GaugeOpts{
-		Name:      "scrape_error",
-		Namespace: Namespace,
-		Help:      "Returns 1 if the last scrape failed",
-	})
-}
+	e.mu.Lock()
+	d.Protocol = pd.Protocol
+	d.WorkInfo = wi
+	d.Retrieved = now
 
-func convertBoolToFloat(b bool) float64 {
-	if b {
-		return 1.0
+	if isNew {
+		d.History.add(sample{Sampled: d.sampleTime(), Retrieved: now, WorkInfo: wi}, *historySize)
 	}
+	e.mu.Unlock()
 
-	return 0.0
-}
-
-func (e *exporter) calculateMetrics() error {
-	e.Metrics.ScrapeError.Set(0)
+	log.WithContext(ctx).Infoln("Retrieved metrics from", d.SerialNumber)
 
-	err := e.Session.GetWorkInfo()
-	if err != nil {
-		e.Metrics.ScrapeError.Set(1)
-		return err
+	if isNew && d.Schedule.Cadence > 0 {
+		e.Metrics.RefreshIntervalVec.WithLabelValues(d.LabelValues...).Set(d.Schedule.Cadence.Seconds())
 	}
 
-	log.Infoln("Retrieved metrics from", e.Session.SerialNumber)
+	events := e.trackState(ctx, d)
 
-	var labelValues []string
+	labelValues := d.LabelValues
 
-	labelValues = append(
-		labelValues,
-		e.Session.SerialNumber,
-	)
+	// Gauges
 
-	// Standard metrics
-
-	e.Metrics.GridFrequency1Vec.WithLabelValues(labelValues...).Set(e.Session.WorkInfo.GridFrequency1)
-	e.Metrics.GridFrequency2Vec.WithLabelValues(labelValues...).Set(e.Session.WorkInfo.GridFrequency2)
-	e.Metrics.GridVoltage1Vec.WithLabelValues(labelValues...).Set(e.Session.WorkInfo.GridVoltage1)
-	e.Metrics.GridVoltage2Vec.WithLabelValues(labelValues...).Set(e.Session.WorkInfo.GridVoltage2)
-
-	e.Metrics.PvInputVoltage1Vec.WithLabelValues(labelValues...).Set(e.Session.WorkInfo.PvInputVoltage1)
-	e.Metrics.PvInputVoltage2Vec.WithLabelValues(labelValues...).Set(e.Session.WorkInfo.PvInputVoltage2)
-	e.Metrics.PvInputCurrent1Vec.WithLabelValues(labelValues...).Set(e.Session.WorkInfo.PvInputCurrent1)
-	e.Metrics.PvInputCurrent2Vec.WithLabelValues(labelValues...).Set(e.Session.WorkInfo.PvInputCurrent2)
-
-	e.Metrics.AcOutputVoltage1Vec.WithLabelValues(labelValues...).Set(e.Session.WorkInfo.AcOutputVoltage1)
-	e.Metrics.AcOutputVoltage2Vec.WithLabelValues(labelValues...).Set(e.Session.WorkInfo.AcOutputVoltage2)
-	e.Metrics.AcOutputFrequency1Vec.WithLabelValues(labelValues...).Set(e.Session.WorkInfo.AcOutputFrequency1)
-	e.Metrics.AcOutputFrequency2Vec.WithLabelValues(labelValues...).Set(e.Session.WorkInfo.AcOutputFrequency2)
-	e.Metrics.AcOutputApparentPower1Vec.WithLabelValues(labelValues...).Set(e.Session.WorkInfo.AcOutputApparentPower1)
-	e.Metrics.AcOutputApparentPower2Vec.WithLabelValues(labelValues...).Set(e.Session.WorkInfo.AcOutputApparentPower2)
-	e.Metrics.AcOutputActivePower1Vec.WithLabelValues(labelValues...).Set(e.Session.WorkInfo.AcOutputActivePower1)
-	e.Metrics.AcOutputActivePower2Vec.WithLabelValues(labelValues...).Set(e.Session.WorkInfo.AcOutputActivePower2)
-
-	e.Metrics.OutputLoadPercent1Vec.WithLabelValues(labelValues...).Set(e.Session.WorkInfo.OutputLoadPercent1)
-	e.Metrics.OutputLoadPercent2Vec.WithLabelValues(labelValues...).Set(e.Session.WorkInfo.OutputLoadPercent2)
-
-	e.Metrics.BatVoltageVec.WithLabelValues(labelValues...).Set(e.Session.WorkInfo.BatVoltage)
-	e.Metrics.BatCapacityVec.WithLabelValues(labelValues...).Set(e.Session.WorkInfo.BatCapacity)
-	e.Metrics.BatChgCurrentVec.WithLabelValues(labelValues...).Set(e.Session.WorkInfo.BatChgCurrent)
-	e.Metrics.BatDischgCurrentVec.WithLabelValues(labelValues...).Set(e.Session.WorkInfo.BatDischgCurrent)
-
-	e.Metrics.TotalPvInputPowerVec.WithLabelValues(labelValues...).Set(e.Session.WorkInfo.TotalPvInputPower)
-	e.Metrics.TotalOutputLoadPercentVec.WithLabelValues(labelValues...).Set(e.Session.WorkInfo.TotalOutputLoadPercent)
-	e.Metrics.TotalBatChgCurrentVec.WithLabelValues(labelValues...).Set(e.Session.WorkInfo.TotalBatChgCurrent)
-	e.Metrics.TotalAcOutputApparentPowerVec.WithLabelValues(labelValues...).Set(e.Session.WorkInfo.TotalAcOutputApparentPower)
-	e.Metrics.TotalAcOutputActivePowerVec.WithLabelValues(labelValues...).Set(e.Session.WorkInfo.TotalAcOutputActivePower)
+	for i := range e.Metrics.Gauges {
+		e.Metrics.Gauges[i].set(labelValues, &d.WorkInfo)
+	}
 
 	// Named statuses
 
-	var labelValuesChargeSource []string = append(
-		labelValues,
-		e.Session.WorkInfo.ChargeSource,
-	)
+	e.setEnum(e.Metrics.ChargeSourceVec, "charge_source", d)
+	e.setEnum(e.Metrics.LoadSourceVec, "load_source", d)
+	e.setEnum(e.Metrics.WorkModeVec, "work_mode", d)
 
-	e.Metrics.ChargeSourceVec.Reset()
-	e.Metrics.ChargeSourceVec.WithLabelValues(labelValuesChargeSource...).Set(1)
+	// Device info
 
-	var labelValuesLoadSource []string = append(
+	var labelValuesDeviceInfo []string = append(
 		labelValues,
-		e.Session.WorkInfo.LoadSource,
+		d.WorkInfo.MachineType,
+		d.Protocol,
 	)
 
-	e.Metrics.LoadSourceVec.Reset()
-	e.Metrics.LoadSourceVec.WithLabelValues(labelValuesLoadSource...).Set(1)
-
-	var labelValuesWorkMode []string = append(
-		labelValues,
-		e.Session.WorkInfo.WorkMode,
-	)
+	e.Metrics.DeviceInfoVec.DeletePartialMatch(prometheus.Labels{LabelSerialNumber: d.SerialNumber})
+	e.Metrics.DeviceInfoVec.WithLabelValues(labelValuesDeviceInfo...).Set(1)
 
-	e.Metrics.WorkModeVec.Reset()
-	e.Metrics.WorkModeVec.WithLabelValues(labelValuesWorkMode...).Set(1)
+	if e.Discover {
+		e.Metrics.DeviceOnlineVec.WithLabelValues(labelValues...).Set(convertBoolToFloat(d.Online))
+	}
 
-	// Boolean statuses
+	if isNew {
+		e.publish(d)
+	}
 
-	e.Metrics.HasLoad1Vec.WithLabelValues(labelValues...).Set(convertBoolToFloat(e.Session.WorkInfo.HasLoad1))
-	e.Metrics.HasLoad2Vec.WithLabelValues(labelValues...).Set(convertBoolToFloat(e.Session.WorkInfo.HasLoad2))
-	e.Metrics.ACChargeOn1Vec.WithLabelValues(labelValues...).Set(convertBoolToFloat(e.Session.WorkInfo.ACchargeOn1))
-	e.Metrics.ACChargeOn2Vec.WithLabelValues(labelValues...).Set(convertBoolToFloat(e.Session.WorkInfo.ACchargeOn2))
-	e.Metrics.SCCChargeOn1Vec.WithLabelValues(labelValues...).Set(convertBoolToFloat(e.Session.WorkInfo.SCCchargeOn1))
-	e.Metrics.SCCChargeOn2Vec.WithLabelValues(labelValues...).Set(convertBoolToFloat(e.Session.WorkInfo.SCCchargeOn2))
-	e.Metrics.LineLoss1Vec.WithLabelValues(labelValues...).Set(convertBoolToFloat(e.Session.WorkInfo.LineLoss1))
-	e.Metrics.LineLoss2Vec.WithLabelValues(labelValues...).Set(convertBoolToFloat(e.Session.WorkInfo.LineLoss2))
-	e.Metrics.OverloadVec.WithLabelValues(labelValues...).Set(convertBoolToFloat(e.Session.WorkInfo.OverLoad))
+	if e.Stream != nil {
+		e.Stream.publishEvents(events)
+	}
 
 	return nil
 }
 
-func startMetricsTicker(e *exporter, t time.Duration) {
+// Persists the tracked state if a state file is configured.
+func (e *exporter) saveState() {
+	if *stateFile == "" {
+		return
+	}
+
+	e.mu.RLock()
+	err := e.State.save(*stateFile)
+	e.mu.RUnlock()
+
+	if err != nil {
+		log.Warnln("Error saving state:", err)
+	}
+}
+
+// Polls all devices every interval until the context is cancelled.
+func startMetricsTicker(ctx context.Context, e *exporter, t time.Duration) {
 	tck := time.NewTicker(t)
 	defer tck.Stop()
 
 	for {
 		select {
+		case <-ctx.Done():
+			return
 		case <-tck.C:
 			err := e.calculateMetrics()
 			if err != nil {
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"time"
+
+	"github.com/marevers/power-datacenter-exporter/pkg/pdc"
+)
+
+// sample is a work info retrieved from the portal
+type sample struct {
+	// Sampled is the time the work info was sampled on the device, see device.sampleTime
+	Sampled   time.Time
+	Retrieved time.Time
+	WorkInfo  pdc.WorkInfo
+}
+
+// history is a ring buffer of the most recent samples of a device
+type history struct {
+	Samples []sample
+	// Next is the index the next sample is written to once the buffer is full
+	Next int
+}
+
+// Adds a sample, overwriting the oldest one if the buffer holds size samples.
+func (h *history) add(s sample, size int) {
+	if size <= 0 {
+		return
+	}
+
+	if len(h.Samples) < size {
+		h.Samples = append(h.Samples, s)
+		return
+	}
+
+	h.Samples[h.Next] = s
+	h.Next = (h.Next + 1) % len(h.Samples)
+}
+
+// Returns the samples sampled after the given time, oldest first.
+func (h *history) since(t time.Time) []sample {
+	var samples []sample
+
+	for i := range h.Samples {
+		s := h.Samples[(h.Next+i)%len(h.Samples)]
+
+		if s.Sampled.After(t) {
+			samples = append(samples, s)
+		}
+	}
+
+	return samples
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Home Assistant entity components
+	haSensor       = "sensor"
+	haBinarySensor = "binary_sensor"
+
+	// Home Assistant state classes
+	haMeasurement = "measurement"
+
+	// Home Assistant entity categories
+	haDiagnostic = "diagnostic"
+)
+
+// haEntity describes the Home Assistant entity of a work info field
+type haEntity struct {
+	Component      string
+	Name           string
+	DeviceClass    string
+	StateClass     string
+	Unit           string
+	EntityCategory string
+	ValueTemplate  string
+}
+
+// Returns a sensor entity with the given name, device class and unit.
+func haMeasurementSensor(name, deviceClass, unit string) haEntity {
+	return haEntity{Component: haSensor, Name: name, DeviceClass: deviceClass, StateClass: haMeasurement, Unit: unit}
+}
+
+// haEntities are the Home Assistant entities by field name, see workInfoFields
+var haEntities = map[string]haEntity{
+	"serial_no":                      {Component: haSensor, Name: "Serial number", EntityCategory: haDiagnostic},
+	"grid_frequency":                 haMeasurementSensor("Grid 1 frequency", "frequency", "Hz"),
+	"grid_frequency2":                haMeasurementSensor("Grid 2 frequency", "frequency", "Hz"),
+	"grid_voltage":                   haMeasurementSensor("Grid 1 voltage", "voltage", "V"),
+	"grid_voltage2":                  haMeasurementSensor("Grid 2 voltage", "voltage", "V"),
+	"pv_input_voltage1":              haMeasurementSensor("PV 1 voltage", "voltage", "V"),
+	"pv_input_voltage2":              haMeasurementSensor("PV 2 voltage", "voltage", "V"),
+	"pv_input_current1":              haMeasurementSensor("PV 1 current", "current", "A"),
+	"pv_input_current2":              haMeasurementSensor("PV 2 current", "current", "A"),
+	"total_pv_input_power":           haMeasurementSensor("PV power", "power", "W"),
+	"ac_output_voltage":              haMeasurementSensor("AC output 1 voltage", "voltage", "V"),
+	"ac_output_voltage2":             haMeasurementSensor("AC output 2 voltage", "voltage", "V"),
+	"ac_output_frequency":            haMeasurementSensor("AC output 1 frequency", "frequency", "Hz"),
+	"ac_output_frequency2":           haMeasurementSensor("AC output 2 frequency", "frequency", "Hz"),
+	"ac_output_apparent_power":       haMeasurementSensor("AC output 1 apparent power", "apparent_power", "VA"),
+	"ac_output_apparent_power2":      haMeasurementSensor("AC output 2 apparent power", "apparent_power", "VA"),
+	"ac_output_active_power":         haMeasurementSensor("AC output 1 power", "power", "W"),
+	"ac_output_active_power2":        haMeasurementSensor("AC output 2 power", "power", "W"),
+	"output_load_percent":            haMeasurementSensor("Output 1 load", "", "%"),
+	"output_load_percent2":           haMeasurementSensor("Output 2 load", "", "%"),
+	"total_output_load_percent":      haMeasurementSensor("Load", "", "%"),
+	"battery_voltage":                haMeasurementSensor("Battery voltage", "voltage", "V"),
+	"battery_capacity":               haMeasurementSensor("Battery", "battery", "%"),
+	"battery_chg_current":            haMeasurementSensor("Battery charging current", "current", "A"),
+	"total_charging_current":         haMeasurementSensor("Total charging current", "current", "A"),
+	"battery_dischg_current":         haMeasurementSensor("Battery discharge current", "current", "A"),
+	"total_ac_output_apparent_power": haMeasurementSensor("AC output apparent power", "apparent_power", "VA"),
+	"total_ac_output_active_power":   haMeasurementSensor("AC output power", "power", "W"),
+	"charge_source":                  {Component: haSensor, Name: "Charge source"},
+	"load_source":                    {Component: haSensor, Name: "Load source"},
+	"work_mode":                      {Component: haSensor, Name: "Work mode"},
+	"machine_type":                   {Component: haSensor, Name: "Machine type", EntityCategory: haDiagnostic},
+	"has_load":                       {Component: haBinarySensor, Name: "Output 1 load", DeviceClass: "power"},
+	"has_load2":                      {Component: haBinarySensor, Name: "Output 2 load", DeviceClass: "power"},
+	"ac_charge_on":                   {Component: haBinarySensor, Name: "AC charging 1", DeviceClass: "battery_charging"},
+	"ac_charge_on2":                  {Component: haBinarySensor, Name: "AC charging 2", DeviceClass: "battery_charging"},
+	"charge_on":                      {Component: haBinarySensor, Name: "Charging", DeviceClass: "battery_charging"},
+	"scc_charge_on":                  {Component: haBinarySensor, Name: "Solar charging 1", DeviceClass: "battery_charging"},
+	"scc_charge_on2":                 {Component: haBinarySensor, Name: "Solar charging 2", DeviceClass: "battery_charging"},
+	"line_loss":                      {Component: haBinarySensor, Name: "Grid 1 lost", DeviceClass: "problem"},
+	"line_loss2":                     {Component: haBinarySensor, Name: "Grid 2 lost", DeviceClass: "problem"},
+	"over_load":                      {Component: haBinarySensor, Name: "Overload", DeviceClass: "problem"},
+	"timestr":                        {Component: haSensor, Name: "Sample time (device)", EntityCategory: haDiagnostic},
+	"data_id":                        {Component: haSensor, Name: "Data ID", EntityCategory: haDiagnostic},
+	"timestamp": {
+		Component:     haSensor,
+		Name:          "Sample time",
+		DeviceClass:   "timestamp",
+		ValueTemplate: "{{ value | int | timestamp_custom('%Y-%m-%dT%H:%M:%S+00:00', false) }}",
+	},
+}
+
+// haDevice is the Home Assistant device the entities of an inverter are grouped under
+type haDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Model        string   `json:"model,omitempty"`
+	SerialNumber string   `json:"serial_number"`
+}
+
+// haConfig is the discovery config of a Home Assistant entity
+type haConfig struct {
+	Name              string   `json:"name"`
+	UniqueID          string   `json:"unique_id"`
+	StateTopic        string   `json:"state_topic"`
+	AvailabilityTopic string   `json:"availability_topic"`
+	DeviceClass       string   `json:"device_class,omitempty"`
+	StateClass        string   `json:"state_class,omitempty"`
+	Unit              string   `json:"unit_of_measurement,omitempty"`
+	EntityCategory    string   `json:"entity_category,omitempty"`
+	ValueTemplate     string   `json:"value_template,omitempty"`
+	PayloadOn         string   `json:"payload_on,omitempty"`
+	PayloadOff        string   `json:"payload_off,omitempty"`
+	Device            haDevice `json:"device"`
+}
+
+// Returns the retained Home Assistant discovery configs for the given fields of the device.
+func (p *mqttPublisher) discoveryMessages(d *device, fields []field) []mqttMessage {
+	id := "pdc_" + toSnakeCase(d.SerialNumber)
+
+	dev := haDevice{
+		Identifiers:  []string{id},
+		Name:         d.Name,
+		Model:        d.machineType(),
+		SerialNumber: d.SerialNumber,
+	}
+
+	if dev.Name == "" {
+		dev.Name = d.SerialNumber
+	}
+
+	var msgs []mqttMessage
+
+	for _, f := range fields {
+		ent, ok := haEntities[f.Name]
+		if !ok {
+			continue
+		}
+
+		c := haConfig{
+			Name:              ent.Name,
+			UniqueID:          id + "_" + f.Name,
+			StateTopic:        p.Prefix + "/" + d.SerialNumber + "/" + f.Name,
+			AvailabilityTopic: p.availabilityTopic(),
+			DeviceClass:       ent.DeviceClass,
+			StateClass:        ent.StateClass,
+			Unit:              ent.Unit,
+			EntityCategory:    ent.EntityCategory,
+			ValueTemplate:     ent.ValueTemplate,
+			Device:            dev,
+		}
+
+		if ent.Component == haBinarySensor {
+			c.PayloadOn = formatFieldValue(true)
+			c.PayloadOff = formatFieldValue(false)
+		}
+
+		b, err := json.Marshal(c)
+		if err != nil {
+			log.Warnln("Error encoding Home Assistant discovery config:", err)
+			continue
+		}
+
+		msgs = append(msgs, mqttMessage{
+			Topic:   *mqttHomeAssistantPrefix + "/" + ent.Component + "/" + id + "/" + f.Name + "/config",
+			Payload: b,
+			Retain:  true,
+		})
+	}
+
+	return msgs
+}
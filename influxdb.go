@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Maximum delay between retries of failed writes
+	influxMaxBackoff = 5 * time.Minute
+
+	// Number of points that can be queued while a write is in progress
+	influxQueueSize = 1000
+)
+
+var (
+	influxEscapeMeasurement = strings.NewReplacer(`,`, `\,`, ` `, `\ `)
+	influxEscapeKey         = strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `)
+	influxEscapeString      = strings.NewReplacer(`"`, `\"`, `\`, `\\`)
+)
+
+// influxPublisher writes the work info of every device in line protocol to InfluxDB.
+// Points are written in batches, and kept in a bounded buffer that is optionally
+// persisted to disk while InfluxDB is unavailable.
+type influxPublisher struct {
+	Client   *http.Client
+	WriteURL string
+	Header   http.Header
+
+	Points  chan string
+	Done    chan struct{}
+	Stopped chan struct{}
+
+	// Pending are the points not written yet, oldest first. Only used by the writer goroutine.
+	Pending     []string
+	PendingSize int
+	Backoff     time.Duration
+	NextTry     time.Time
+
+	WrittenPoints prometheus.Counter
+	DroppedPoints prometheus.Counter
+	WriteErrors   prometheus.Counter
+	Buffered      prometheus.Gauge
+}
+
+// Returns a publisher for the InfluxDB configured by the influxdb flags and starts writing.
+func newInfluxPublisher(reg prometheus.Registerer) (*influxPublisher, error) {
+	p := &influxPublisher{
+		Client: &http.Client{Timeout: 20 * time.Second},
+		Header: http.Header{"Content-Type": []string{"text/plain; charset=utf-8"}},
+		Points: make(chan string, influxQueueSize),
+		Done:   make(chan struct{}),
+	}
+
+	q := url.Values{"precision": []string{"s"}}
+
+	switch *influxVersion {
+	case 1:
+		q.Set("db", *influxDatabase)
+
+		if *influxRetentionPolicy != "" {
+			q.Set("rp", *influxRetentionPolicy)
+		}
+
+		p.WriteURL = strings.TrimSuffix(*influxURL, "/") + "/write?" + q.Encode()
+	case 2:
+		q.Set("org", *influxOrg)
+		q.Set("bucket", *influxBucket)
+
+		if *influxToken != "" {
+			p.Header.Set("Authorization", "Token "+*influxToken)
+		}
+
+		p.WriteURL = strings.TrimSuffix(*influxURL, "/") + "/api/v2/write?" + q.Encode()
+	default:
+		return nil, fmt.Errorf("invalid InfluxDB version: %d", *influxVersion)
+	}
+
+	p.WrittenPoints = promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name:      "influxdb_points_written_total",
+		Namespace: Namespace,
+		Help:      "Number of points written to InfluxDB",
+	})
+
+	p.DroppedPoints = promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name:      "influxdb_points_dropped_total",
+		Namespace: Namespace,
+		Help:      "Number of points dropped because the buffer was full or InfluxDB rejected them",
+	})
+
+	p.WriteErrors = promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name:      "influxdb_write_errors_total",
+		Namespace: Namespace,
+		Help:      "Number of failed writes to InfluxDB",
+	})
+
+	p.Buffered = promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+		Name:      "influxdb_buffered_points",
+		Namespace: Namespace,
+		Help:      "Number of points waiting to be written to InfluxDB",
+	})
+
+	if err := p.loadBuffer(); err != nil {
+		return nil, fmt.Errorf("error loading InfluxDB buffer: %w", err)
+	}
+
+	p.Stopped = make(chan struct{})
+
+	go p.run()
+
+	return p, nil
+}
+
+func (p *influxPublisher) publish(d *device) {
+	line := influxLine(d)
+
+	select {
+	case p.Points <- line:
+	default:
+		log.Warnln("InfluxDB writer is busy, dropped point of", d.SerialNumber)
+		p.DroppedPoints.Inc()
+	}
+}
+
+// Returns the work info of the device as a point in line protocol,
+// tagged with the serial number and name and timestamped with the sample time.
+func influxLine(d *device) string {
+	var b strings.Builder
+
+	b.WriteString(influxEscapeMeasurement.Replace(*influxMeasurement))
+	b.WriteString("," + LabelSerialNumber + "=" + influxEscapeKey.Replace(d.SerialNumber))
+
+	if d.Name != "" {
+		b.WriteString("," + LabelDeviceName + "=" + influxEscapeKey.Replace(d.Name))
+	}
+
+	for i, f := range workInfoFields(&d.WorkInfo) {
+		if i == 0 {
+			b.WriteByte(' ')
+		} else {
+			b.WriteByte(',')
+		}
+
+		b.WriteString(influxEscapeKey.Replace(f.Name) + "=")
+
+		switch v := f.Value.(type) {
+		case string:
+			b.WriteString(`"` + influxEscapeString.Replace(v) + `"`)
+		default:
+			b.WriteString(formatFieldValue(v))
+		}
+	}
+
+	b.WriteString(" " + strconv.FormatInt(d.sampleTime().Unix(), 10))
+
+	return b.String()
+}
+
+// Adds points to the buffer and writes them in batches until the publisher is closed.
+func (p *influxPublisher) run() {
+	defer close(p.Stopped)
+
+	tck := time.NewTicker(time.Duration(*influxFlushInterval) * time.Second)
+	defer tck.Stop()
+
+	for {
+		select {
+		case line := <-p.Points:
+			p.add(line)
+
+			if len(p.Pending) >= *influxBatchSize {
+				p.flush()
+			}
+		case <-tck.C:
+			p.flush()
+		case <-p.Done:
+			for len(p.Points) > 0 {
+				p.add(<-p.Points)
+			}
+
+			p.NextTry = time.Time{}
+			p.flush()
+
+			return
+		}
+	}
+}
+
+// Adds a point to the buffer, dropping the oldest points if it is full.
+func (p *influxPublisher) add(line string) {
+	p.Pending = append(p.Pending, line)
+	p.PendingSize += len(line) + 1
+
+	for p.PendingSize > *influxBufferSize && len(p.Pending) > 1 {
+		p.PendingSize -= len(p.Pending[0]) + 1
+		p.Pending = p.Pending[1:]
+		p.DroppedPoints.Inc()
+	}
+
+	p.Buffered.Set(float64(len(p.Pending)))
+}
+
+// Writes the buffered points in batches. On failure the remaining points
+// are kept and retried with an increasing delay.
+func (p *influxPublisher) flush() {
+	if len(p.Pending) == 0 || time.Now().Before(p.NextTry) {
+		return
+	}
+
+	defer p.saveBuffer()
+
+	for len(p.Pending) > 0 {
+		n := min(len(p.Pending), *influxBatchSize)
+
+		err := p.write(p.Pending[:n])
+
+		var perr *influxPermanentError
+
+		switch {
+		case errors.As(err, &perr):
+			log.Warnf("InfluxDB rejected %d points, dropping them: %v", n, err)
+			p.DroppedPoints.Add(float64(n))
+		case err != nil:
+			flushInterval := time.Duration(*influxFlushInterval) * time.Second
+
+			p.Backoff = min(max(p.Backoff*2, flushInterval), influxMaxBackoff)
+			p.NextTry = time.Now().Add(p.Backoff)
+
+			log.Warnf("Error writing to InfluxDB, retrying %d buffered points in %v: %v", len(p.Pending), p.Backoff, err)
+
+			return
+		default:
+			p.WrittenPoints.Add(float64(n))
+		}
+
+		p.Backoff = 0
+
+		for _, l := range p.Pending[:n] {
+			p.PendingSize -= len(l) + 1
+		}
+
+		p.Pending = p.Pending[n:]
+		p.Buffered.Set(float64(len(p.Pending)))
+	}
+}
+
+// influxPermanentError is a write error that does not succeed when retried
+type influxPermanentError struct {
+	error
+}
+
+// Writes a batch of points.
+func (p *influxPublisher) write(lines []string) error {
+	req, err := http.NewRequest(http.MethodPost, p.WriteURL, strings.NewReader(strings.Join(lines, "\n")))
+	if err != nil {
+		return err
+	}
+
+	req.Header = p.Header.Clone()
+
+	if *influxVersion == 1 && *influxUsername != "" {
+		req.SetBasicAuth(*influxUsername, *influxPassword)
+	}
+
+	res, err := p.Client.Do(req)
+	if err != nil {
+		p.WriteErrors.Inc()
+		return err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNoContent || res.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	p.WriteErrors.Inc()
+
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+	err = fmt.Errorf("HTTP %v %v: %s", res.StatusCode, http.StatusText(res.StatusCode), bytes.TrimSpace(body))
+
+	// Malformed or too large points are rejected again when retried
+	switch res.StatusCode {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+		return &influxPermanentError{err}
+	}
+
+	return err
+}
+
+// Reads the buffered points from the buffer file if configured.
+func (p *influxPublisher) loadBuffer() error {
+	if *influxBufferPath == "" {
+		return nil
+	}
+
+	b, err := os.ReadFile(*influxBufferPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, l := range strings.Split(string(b), "\n") {
+		if l != "" {
+			p.add(l)
+		}
+	}
+
+	if len(p.Pending) > 0 {
+		log.Infof("Loaded %d buffered InfluxDB points", len(p.Pending))
+	}
+
+	return nil
+}
+
+// Persists the buffered points to the buffer file if configured.
+func (p *influxPublisher) saveBuffer() {
+	if *influxBufferPath == "" {
+		return
+	}
+
+	var b []byte
+
+	for _, l := range p.Pending {
+		b = append(b, l...)
+		b = append(b, '\n')
+	}
+
+	if err := writeFileAtomic(*influxBufferPath, b); err != nil {
+		log.Warnln("Error saving InfluxDB buffer:", err)
+	}
+}
+
+func (p *influxPublisher) close() {
+	close(p.Done)
+	<-p.Stopped
+}
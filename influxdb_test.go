@@ -0,0 +1,467 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// testInfluxDB is an InfluxDB write endpoint recording every request made to it
+type testInfluxDB struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	Requests []*http.Request
+	Bodies   []string
+	// Statuses are the responses to the consecutive requests, 204 once exhausted
+	Statuses []int
+}
+
+func newTestInfluxDB(t *testing.T, statuses ...int) *testInfluxDB {
+	db := &testInfluxDB{Statuses: statuses}
+
+	db.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		db.mu.Lock()
+		defer db.mu.Unlock()
+
+		status := http.StatusNoContent
+		if i := len(db.Requests); i < len(db.Statuses) {
+			status = db.Statuses[i]
+		}
+
+		db.Requests = append(db.Requests, r)
+		db.Bodies = append(db.Bodies, string(body))
+
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(db.Close)
+
+	return db
+}
+
+// Returns the number of points written in each request.
+func (db *testInfluxDB) batches() []int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var n []int
+
+	for _, b := range db.Bodies {
+		n = append(n, len(strings.Split(b, "\n")))
+	}
+
+	return n
+}
+
+// Returns a publisher writing to the URL whose writer goroutine is stopped,
+// so the buffer can be filled and flushed synchronously.
+func newTestInfluxPublisher(t *testing.T, url string) *influxPublisher {
+	t.Helper()
+
+	setFlag(t, influxURL, url)
+	setFlag(t, influxFlushInterval, 10)
+
+	p, err := newInfluxPublisher(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.close()
+
+	return p
+}
+
+func TestInfluxLine(t *testing.T) {
+	tests := []struct {
+		name        string
+		measurement string
+		deviceName  string
+		timestr     string
+		prefix      string
+		contains    []string
+	}{
+		{
+			name:        "tags",
+			measurement: "pdc",
+			deviceName:  "Garage",
+			timestr:     "2024-06-01 14:35:07",
+			prefix:      "pdc,serialno=92632105100000,name=Garage serial_no=\"92632105100000\",",
+			contains:    []string{",battery_voltage=52.6,", ",battery_capacity=87,", ",has_load=true,", ",work_mode=\"Battery Mode\","},
+		},
+		{
+			name:        "no name",
+			measurement: "pdc",
+			timestr:     "2024-06-01 14:35:07",
+			prefix:      "pdc,serialno=92632105100000 ",
+		},
+		{
+			name:        "escaped measurement and tags",
+			measurement: "pdc readings,v2",
+			deviceName:  "Garage, east=1",
+			timestr:     "2024-06-01 14:35:07",
+			prefix:      `pdc\ readings\,v2,serialno=92632105100000,name=Garage\,\ east\=1 `,
+		},
+		{
+			name:        "escaped string field",
+			measurement: "pdc",
+			timestr:     `say "hi" \o/`,
+			contains:    []string{`,timestr="say \"hi\" \\o/",`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, influxMeasurement, tt.measurement)
+
+			d := testDevice()
+			d.Name = tt.deviceName
+			d.WorkInfo.Timestr = tt.timestr
+
+			got := influxLine(d)
+
+			if !strings.HasPrefix(got, tt.prefix) {
+				t.Errorf("influxLine() = %s, want prefix %s", got, tt.prefix)
+			}
+
+			for _, s := range tt.contains {
+				if !strings.Contains(got, s) {
+					t.Errorf("influxLine() = %s, want it to contain %s", got, s)
+				}
+			}
+
+			if !strings.HasSuffix(got, " 1717245307") {
+				t.Errorf("influxLine() = %s, want the sample time as timestamp", got)
+			}
+		})
+	}
+}
+
+func TestInfluxWrite(t *testing.T) {
+	tests := []struct {
+		name     string
+		version  int
+		path     string
+		query    map[string]string
+		username string
+		token    string
+		auth     string
+	}{
+		{
+			name:    "v1",
+			version: 1,
+			path:    "/write",
+			query:   map[string]string{"db": "pdc", "rp": "autogen", "precision": "s"},
+		},
+		{
+			name:     "v1 with credentials",
+			version:  1,
+			path:     "/write",
+			query:    map[string]string{"db": "pdc", "precision": "s"},
+			username: "writer",
+			auth:     "Basic d3JpdGVyOnNlY3JldA==",
+		},
+		{
+			name:    "v2",
+			version: 2,
+			path:    "/api/v2/write",
+			query:   map[string]string{"org": "home", "bucket": "solar", "precision": "s"},
+			token:   "abc",
+			auth:    "Token abc",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestInfluxDB(t)
+
+			setFlag(t, influxURL, db.URL+"/")
+			setFlag(t, influxVersion, tt.version)
+			setFlag(t, influxDatabase, "pdc")
+			setFlag(t, influxRetentionPolicy, tt.query["rp"])
+			setFlag(t, influxUsername, tt.username)
+			setFlag(t, influxPassword, "secret")
+			setFlag(t, influxOrg, "home")
+			setFlag(t, influxBucket, "solar")
+			setFlag(t, influxToken, tt.token)
+			setFlag(t, influxFlushInterval, 3600)
+
+			p, err := newInfluxPublisher(prometheus.NewRegistry())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			d := testDevice()
+			p.publish(d)
+
+			// Closing flushes the pending point
+			p.close()
+
+			if len(db.Requests) != 1 {
+				t.Fatalf("requests = %d, want 1", len(db.Requests))
+			}
+
+			r := db.Requests[0]
+
+			if r.Method != http.MethodPost || r.URL.Path != tt.path {
+				t.Errorf("request = %s %s, want POST %s", r.Method, r.URL.Path, tt.path)
+			}
+
+			q := r.URL.Query()
+
+			if len(q) != len(tt.query) {
+				t.Errorf("query = %v, want %v", q, tt.query)
+			}
+
+			for k, v := range tt.query {
+				if q.Get(k) != v {
+					t.Errorf("query %s = %s, want %s", k, q.Get(k), v)
+				}
+			}
+
+			if got := r.Header.Get("Authorization"); got != tt.auth {
+				t.Errorf("authorization = %q, want %q", got, tt.auth)
+			}
+
+			if db.Bodies[0] != influxLine(d) {
+				t.Errorf("body = %s, want %s", db.Bodies[0], influxLine(d))
+			}
+
+			if got := testutil.ToFloat64(p.WrittenPoints); got != 1 {
+				t.Errorf("written points = %v, want 1", got)
+			}
+		})
+	}
+}
+
+func TestInfluxFlush(t *testing.T) {
+	tests := []struct {
+		name      string
+		statuses  []int
+		points    int
+		batches   []int
+		pending   int
+		written   float64
+		dropped   float64
+		retrying  bool
+		errorsInc float64
+	}{
+		{
+			name:    "batches",
+			points:  5,
+			batches: []int{2, 2, 1},
+			written: 5,
+		},
+		{
+			name:      "server error is retried",
+			statuses:  []int{http.StatusNoContent, http.StatusServiceUnavailable},
+			points:    5,
+			batches:   []int{2, 2},
+			pending:   3,
+			written:   2,
+			retrying:  true,
+			errorsInc: 1,
+		},
+		{
+			name:      "rejected points are dropped",
+			statuses:  []int{http.StatusBadRequest, http.StatusNoContent, http.StatusUnprocessableEntity},
+			points:    5,
+			batches:   []int{2, 2, 1},
+			written:   2,
+			dropped:   3,
+			errorsInc: 2,
+		},
+		{
+			name:      "too large points are dropped",
+			statuses:  []int{http.StatusRequestEntityTooLarge},
+			points:    3,
+			batches:   []int{2, 1},
+			written:   1,
+			dropped:   2,
+			errorsInc: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestInfluxDB(t, tt.statuses...)
+
+			setFlag(t, influxBatchSize, 2)
+
+			p := newTestInfluxPublisher(t, db.URL)
+
+			for i := 0; i < tt.points; i++ {
+				p.add(influxLine(testDevice()))
+			}
+
+			p.flush()
+
+			if got := db.batches(); !slices.Equal(got, tt.batches) {
+				t.Errorf("batches = %v, want %v", got, tt.batches)
+			}
+
+			if len(p.Pending) != tt.pending {
+				t.Errorf("pending = %d, want %d", len(p.Pending), tt.pending)
+			}
+
+			if got := testutil.ToFloat64(p.Buffered); got != float64(tt.pending) {
+				t.Errorf("buffered points = %v, want %d", got, tt.pending)
+			}
+
+			if got := testutil.ToFloat64(p.WrittenPoints); got != tt.written {
+				t.Errorf("written points = %v, want %v", got, tt.written)
+			}
+
+			if got := testutil.ToFloat64(p.DroppedPoints); got != tt.dropped {
+				t.Errorf("dropped points = %v, want %v", got, tt.dropped)
+			}
+
+			if got := testutil.ToFloat64(p.WriteErrors); got != tt.errorsInc {
+				t.Errorf("write errors = %v, want %v", got, tt.errorsInc)
+			}
+
+			if retrying := !p.NextTry.IsZero(); retrying != tt.retrying {
+				t.Errorf("retrying = %v, want %v", retrying, tt.retrying)
+			}
+		})
+	}
+}
+
+func TestInfluxBackoff(t *testing.T) {
+	db := newTestInfluxDB(t, http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable,
+		http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+
+	p := newTestInfluxPublisher(t, db.URL)
+	p.add(influxLine(testDevice()))
+
+	for i, want := range []time.Duration{
+		10 * time.Second, 20 * time.Second, 40 * time.Second, 80 * time.Second,
+		160 * time.Second, influxMaxBackoff, influxMaxBackoff, 0,
+	} {
+		start := time.Now()
+
+		p.flush()
+
+		if p.Backoff != want {
+			t.Errorf("attempt %d: backoff = %v, want %v", i, p.Backoff, want)
+		}
+
+		if want > 0 && p.NextTry.Before(start.Add(want)) {
+			t.Errorf("attempt %d: next try in %v, want %v", i, p.NextTry.Sub(start), want)
+		}
+
+		// Flushing again before the next try does not write
+		n := len(db.batches())
+		p.flush()
+
+		if want > 0 && len(db.batches()) != n {
+			t.Errorf("attempt %d: wrote before the next try", i)
+		}
+
+		p.NextTry = time.Time{}
+	}
+
+	if len(p.Pending) != 0 {
+		t.Errorf("pending = %d, want 0", len(p.Pending))
+	}
+}
+
+func TestInfluxBufferSize(t *testing.T) {
+	setFlag(t, influxMeasurement, "pdc")
+
+	// Points of the same size that are told apart by their measurement
+	var lines []string
+
+	for _, m := range []string{"pdca", "pdcb", "pdcc", "pdcd", "pdce"} {
+		lines = append(lines, strings.Replace(influxLine(testDevice()), "pdc,", m+",", 1))
+	}
+
+	size := len(lines[0]) + 1
+
+	tests := []struct {
+		name       string
+		bufferSize int
+		points     int
+		pending    int
+		dropped    float64
+	}{
+		{"fits", 3 * size, 3, 3, 0},
+		{"oldest are dropped", 3 * size, 5, 3, 2},
+		{"partial point", 3*size - 1, 3, 2, 1},
+		{"keeps the latest point", 1, 2, 1, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, influxBufferSize, tt.bufferSize)
+
+			p := newTestInfluxPublisher(t, "http://127.0.0.1:1")
+
+			for _, l := range lines[:tt.points] {
+				p.add(l)
+			}
+
+			if want := lines[tt.points-tt.pending : tt.points]; !slices.Equal(p.Pending, want) {
+				t.Errorf("pending = %d points, want the latest %d", len(p.Pending), tt.pending)
+			}
+
+			if p.PendingSize != tt.pending*size {
+				t.Errorf("pending size = %d, want %d", p.PendingSize, tt.pending*size)
+			}
+
+			if got := testutil.ToFloat64(p.DroppedPoints); got != tt.dropped {
+				t.Errorf("dropped points = %v, want %v", got, tt.dropped)
+			}
+		})
+	}
+}
+
+func TestInfluxBufferFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "influxdb.buffer")
+
+	setFlag(t, influxBufferPath, path)
+
+	// An unavailable InfluxDB keeps the points in the buffer, which is saved after the failed flush
+	p := newTestInfluxPublisher(t, "http://127.0.0.1:1")
+
+	lines := []string{influxLine(testDevice()), `pdc,serialno=1 work_mode="a\"b" 1717245367`}
+
+	for _, l := range lines {
+		p.add(l)
+	}
+
+	p.flush()
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := strings.Join(lines, "\n") + "\n"; string(b) != want {
+		t.Errorf("buffer file = %q, want %q", b, want)
+	}
+
+	// A new publisher loads the buffer and writes it once InfluxDB is available
+	db := newTestInfluxDB(t)
+
+	newTestInfluxPublisher(t, db.URL)
+
+	if len(db.Bodies) != 1 || db.Bodies[0] != strings.Join(lines, "\n") {
+		t.Errorf("written = %q, want the loaded points", db.Bodies)
+	}
+
+	if b, err := os.ReadFile(path); err != nil || len(b) != 0 {
+		t.Errorf("buffer file after writing = %q, %v, want empty", b, err)
+	}
+}
@@ -1,58 +1,359 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/marevers/power-datacenter-exporter/pkg/pdc"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 
 	log "github.com/sirupsen/logrus"
 )
 
 var (
 	logLevel     = flag.String("log.level", "info", "Log level for logging.")
-	listenAddr   = flag.String("web.listen-address", ":8080", "The address to listen on for HTTP requests.")
-	metricsPath  = flag.String("web.telemetry-path", "/metrics", "Path under which to expose metrics.")
+	listenAddr   = flag.String("web.listen-address", ":8080", "The address to listen on for HTTP requests, or empty to disable the HTTP server.")
+	metricsPath  = flag.String("web.telemetry-path", "/metrics", "Path under which to expose metrics, or empty to not expose them.")
+	configFile   = flag.String("config.file", "", "Path to the optional configuration file with devices and labels.")
+	once         = flag.Bool("once", false, "Poll all devices once, write the metrics to the output and exit.")
+	output       = flag.String("output", OutputStdout, "Output of the one-shot mode, 'stdout' or 'textfile'.")
+	textfilePath = flag.String("textfile.path", "", "Path of the file the one-shot mode writes to with the textfile output, e.g. /var/lib/node_exporter/pdc.prom.")
+
+	stateFile   = flag.String("state.file", "", "Path to the file the tracked outages and transitions are persisted in across restarts.")
+	historySize = flag.Int("history.size", 2880, "Number of recent samples kept in memory per device for the API, 0 disables the history.")
+
+	streamMaxClients = flag.Int("stream.max-clients", 10, "Maximum number of clients connected to the event stream.")
+	streamBufferSize = flag.Int("stream.buffer-size", 64, "Number of events buffered per stream client, at least 1. Clients falling further behind are disconnected.")
+
 	baseUrl      = flag.String("pdc.baseurl", "", "Base URL to use.")
 	username     = flag.String("pdc.username", "", "Username for logging in.")
 	password     = flag.String("pdc.password", "", "Password for logging in.")
 	serialNumber = flag.String("pdc.serialnumber", "", "Serial number of device.")
+	protocol     = flag.String("pdc.protocol", pdc.Protocol, "Protocol ID of device.")
 	interval     = flag.Int("pdc.interval", 60, "Interval in seconds for data polling.")
+
+	adaptive      = flag.Bool("pdc.adaptive", false, "Poll shortly after the portal is expected to refresh the data, with -pdc.interval as maximum interval.")
+	adaptiveDelay = flag.Int("pdc.adaptive-delay", 15, "Delay in seconds after the expected refresh before polling, doubled while no new data is available.")
+
+	discover          = flag.Bool("pdc.discover", false, "Poll all devices attached to the account instead of a single serial number.")
+	discoveryInterval = flag.Int("pdc.discovery-interval", 600, "Interval in seconds for refreshing the list of discovered devices.")
+
+	naming             = flag.String("metrics.naming", NamingLegacy, "Naming scheme of metrics, 'legacy' or 'standard'.")
+	legacyNames        = flag.Bool("metrics.legacy-names", false, "Also expose metrics under their legacy names when using the standard naming scheme.")
+	timestamps         = flag.Bool("metrics.timestamps", false, "Expose metrics with the time they were sampled on the device instead of the scrape time.")
+	timestampMaxAge    = flag.Int("metrics.timestamp-max-age", 3600, "Maximum age in seconds of samples exposed with their device timestamp, older samples are exposed without timestamp.")
+	statesets          = flag.Bool("metrics.statesets", false, "Expose work mode, charge source and load source as state sets of normalized values.")
+	powerFactorMetrics = flag.Bool("metrics.power-factor", true, "Expose the derived power factor and reactive power metrics.")
+	printMigration     = flag.Bool("metrics.print-migration", false, "Print the migration table from legacy to standard metric names and exit.")
+	printLegacyRules   = flag.Bool("metrics.print-legacy-rules", false, "Print recording rules producing the legacy metric names and exit.")
+
+	mqttBroker                = flag.String("mqtt.broker", "", "MQTT broker to publish readings to, e.g. tcp://localhost:1883 or ssl://broker:8883. Publishing is disabled if empty.")
+	mqttClientID              = flag.String("mqtt.client-id", "power-datacenter-exporter", "Client ID for connecting to the MQTT broker.")
+	mqttUsername              = flag.String("mqtt.username", "", "Username for connecting to the MQTT broker.")
+	mqttPassword              = flag.String("mqtt.password", "", "Password for connecting to the MQTT broker.")
+	mqttTLSCAFile             = flag.String("mqtt.tls.ca-file", "", "CA certificate file to verify the MQTT broker with.")
+	mqttTLSCertFile           = flag.String("mqtt.tls.cert-file", "", "Client certificate file for connecting to the MQTT broker.")
+	mqttTLSKeyFile            = flag.String("mqtt.tls.key-file", "", "Client key file for connecting to the MQTT broker.")
+	mqttTLSInsecureSkipVerify = flag.Bool("mqtt.tls.insecure-skip-verify", false, "Do not verify the certificate of the MQTT broker.")
+	mqttQoS                   = flag.Uint("mqtt.qos", 0, "QoS level of published MQTT messages, 0, 1 or 2.")
+	mqttRetain                = flag.Bool("mqtt.retain", false, "Publish MQTT messages with the retain flag.")
+	mqttTopicPrefix           = flag.String("mqtt.topic-prefix", "pdc", "Prefix of the MQTT topics, followed by the serial number of the device.")
+	mqttHomeAssistant         = flag.Bool("mqtt.homeassistant", false, "Publish Home Assistant discovery configs for the readings of every device.")
+	mqttHomeAssistantPrefix   = flag.String("mqtt.homeassistant.prefix", "homeassistant", "Discovery prefix of Home Assistant.")
+
+	influxURL             = flag.String("influxdb.url", "", "URL of InfluxDB to write readings to, e.g. http://localhost:8086. Writing is disabled if empty.")
+	influxVersion         = flag.Int("influxdb.version", 2, "Version of the InfluxDB write API, 1 or 2.")
+	influxOrg             = flag.String("influxdb.org", "", "Organization to write to with the v2 API.")
+	influxBucket          = flag.String("influxdb.bucket", "", "Bucket to write to with the v2 API.")
+	influxToken           = flag.String("influxdb.token", "", "API token for the v2 API.")
+	influxDatabase        = flag.String("influxdb.database", "", "Database to write to with the v1 API.")
+	influxRetentionPolicy = flag.String("influxdb.retention-policy", "", "Retention policy to write to with the v1 API.")
+	influxUsername        = flag.String("influxdb.username", "", "Username for the v1 API.")
+	influxPassword        = flag.String("influxdb.password", "", "Password for the v1 API.")
+	influxMeasurement     = flag.String("influxdb.measurement", Namespace, "Measurement the readings are written to.")
+	influxBatchSize       = flag.Int("influxdb.batch-size", 100, "Maximum number of points per write.")
+	influxFlushInterval   = flag.Int("influxdb.flush-interval", 10, "Interval in seconds for writing buffered points, and minimum delay before retrying a failed write.")
+	influxBufferSize      = flag.Int("influxdb.buffer-size", 10<<20, "Maximum size in bytes of the points buffered while InfluxDB is unavailable, the oldest points are dropped beyond it.")
+	influxBufferPath      = flag.String("influxdb.buffer-path", "", "Path to the file buffered points are persisted in across restarts. If empty, the buffer is only kept in memory.")
+
+	remoteWriteURL            = flag.String("remote-write.url", "", "URL of a Prometheus remote write endpoint to push metrics to. Pushing is disabled if empty.")
+	remoteWriteInterval       = flag.Int("remote-write.interval", 60, "Interval in seconds for pushing metrics.")
+	remoteWriteUsername       = flag.String("remote-write.username", "", "Username for basic authentication with the remote write endpoint.")
+	remoteWritePassword       = flag.String("remote-write.password", "", "Password for basic authentication with the remote write endpoint.")
+	remoteWriteBearerToken    = flag.String("remote-write.bearer-token", "", "Bearer token for the remote write endpoint.")
+	remoteWriteTenant         = flag.String("remote-write.tenant", "", "Tenant ID sent in the X-Scope-OrgID header, e.g. for Mimir, Cortex or Loki.")
+	remoteWriteJob            = flag.String("remote-write.job", "power-datacenter-exporter", "Value of the job label of pushed metrics.")
+	remoteWriteInstance       = flag.String("remote-write.instance", "", "Value of the instance label of pushed metrics, the hostname if empty.")
+	remoteWriteExternalLabels = flag.String("remote-write.external-labels", "", "Comma separated labels added to pushed metrics, e.g. site=garage,region=eu.")
+	remoteWriteQueueSize      = flag.Int("remote-write.queue-size", 1000, "Maximum number of pushes queued while the endpoint is unavailable, the oldest are dropped beyond it.")
+
+	otlpEndpoint    = flag.String("otlp.endpoint", "", "OTLP collector endpoint as host:port or URL, defaults to the OTEL_EXPORTER_OTLP_ENDPOINT environment variable or localhost.")
+	otlpProtocol    = flag.String("otlp.protocol", OTLPProtocolGRPC, "OTLP protocol, 'grpc' or 'http/protobuf'.")
+	otlpInsecure    = flag.Bool("otlp.insecure", false, "Connect to the OTLP collector without TLS.")
+	otlpHeadersFlag = flag.String("otlp.headers", "", "Comma separated headers sent to the OTLP collector, e.g. authorization=Bearer token.")
+	otlpServiceName = flag.String("otlp.service-name", "power-datacenter-exporter", "Value of the service.name resource attribute.")
+	otlpMetrics     = flag.Bool("otlp.metrics", false, "Export the metrics of every device with OTLP.")
+	otlpInterval    = flag.Int("otlp.metrics-interval", 60, "Interval in seconds for exporting metrics with OTLP.")
+	otlpTraces      = flag.Bool("otlp.traces", false, "Export traces of the poll cycles and portal requests with OTLP.")
+
+	storagePath            = flag.String("storage.path", "", "Path to the SQLite database every sample is stored in. Storage is disabled if empty.")
+	storageRawRetention    = flag.Duration("storage.raw-retention", 30*24*time.Hour, "Retention of the stored raw samples, 0 keeps them forever.")
+	storageHourlyRetention = flag.Duration("storage.hourly-retention", 0, "Retention of the stored hourly aggregates, 0 keeps them forever.")
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		os.Exit(runCheck(os.Args[2:]))
+	}
+
 	flag.Parse()
 
+	if *printMigration {
+		writeMigrationTable(os.Stdout)
+		return
+	}
+
+	if *printLegacyRules {
+		writeLegacyRules(os.Stdout)
+		return
+	}
+
 	if level, err := log.ParseLevel(*logLevel); err != nil {
 		log.Fatalln(err)
 	} else {
 		log.SetLevel(level)
 	}
 
+	if *naming != NamingLegacy && *naming != NamingStandard {
+		log.Fatalln("Invalid naming scheme:", *naming)
+	}
+
+	if *streamBufferSize < 1 {
+		log.Fatalln("Invalid stream buffer size:", *streamBufferSize)
+	}
+
+	if *once {
+		switch {
+		case *output != OutputStdout && *output != OutputTextfile:
+			log.Fatalln("Invalid output:", *output)
+		case *output == OutputTextfile && *textfilePath == "":
+			log.Fatalln("The textfile output requires -textfile.path")
+		case *output == OutputTextfile && *timestamps:
+			log.Fatalln("The textfile output does not support -metrics.timestamps")
+		}
+	}
+
+	cfg := &config{}
+
+	if *configFile != "" {
+		var err error
+
+		cfg, err = loadConfig(*configFile)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	setExtraLabels(cfg.labelNames())
+
+	st, err := loadState(*stateFile)
+	if err != nil {
+		log.Fatalln("Error loading state:", err)
+	}
+
+	var tp *sdktrace.TracerProvider
+
+	if *otlpTraces {
+		tp, err = newOTLPTracerProvider()
+		if err != nil {
+			log.Fatalln("Error creating OTLP tracer provider:", err)
+		}
+
+		otel.SetTracerProvider(tp)
+		log.AddHook(traceLogHook{})
+	}
+
 	ses := pdc.NewSession(*baseUrl, *serialNumber)
 
 	if err := ses.Login(*username, *password); err != nil {
 		log.Fatalln(err)
 	}
 
+	// The one-shot mode only exposes the device metrics, as the Go and process
+	// metrics of a short-lived process would conflict with those of the node_exporter
+	reg := prometheus.NewRegistry()
+	if !*once {
+		reg = createRegistry()
+	}
+
 	exporter := &exporter{
-		Reg:     createRegistry(),
-		Session: ses,
+		Reg:       reg,
+		Session:   ses,
+		Config:    cfg,
+		State:     st,
+		Discover:  *discover,
+		LastLogin: time.Now(),
 	}
 
 	exporter.registerMetrics(labels)
 
-	srv := &http.Server{
-		Addr:    *listenAddr,
-		Handler: exporter.routes(),
+	// The self-metrics of the publishers are meaningless for the short-lived
+	// one-shot process, so they are kept out of its output
+	var publisherReg prometheus.Registerer = exporter.Reg
+	if *once {
+		publisherReg = prometheus.NewRegistry()
 	}
 
-	go startMetricsTicker(exporter, time.Duration(*interval)*time.Second)
+	if *mqttBroker != "" {
+		p, err := newMQTTPublisher(publisherReg)
+		if err != nil {
+			log.Fatalln("Error creating MQTT publisher:", err)
+		}
 
-	log.Println("Starting power-datacenter Exporter at", *listenAddr)
-	err := srv.ListenAndServe()
-	if err != nil {
-		log.Fatalln("Error starting HTTP server:", err)
+		exporter.Publishers = append(exporter.Publishers, p)
+	}
+
+	if *influxURL != "" {
+		p, err := newInfluxPublisher(publisherReg)
+		if err != nil {
+			log.Fatalln("Error creating InfluxDB publisher:", err)
+		}
+
+		exporter.Publishers = append(exporter.Publishers, p)
+	}
+
+	if *storagePath != "" {
+		p, err := newStoragePublisher(publisherReg)
+		if err != nil {
+			log.Fatalln("Error opening storage:", err)
+		}
+
+		exporter.Storage = p
+		exporter.Publishers = append(exporter.Publishers, p)
+	}
+
+	if *discover {
+		if err := exporter.discoverDevices(context.Background()); err != nil {
+			log.Fatalln("Error discovering devices:", err)
+		}
+	} else {
+		exporter.Devices = exporter.configuredDevices()
+
+		if len(exporter.Devices) == 0 {
+			log.Fatalln("No devices configured, set a serial number, devices in the config file or enable discovery")
+		}
+	}
+
+	if *once {
+		code := runOnce(exporter)
+
+		if tp != nil {
+			shutdownTracerProvider(tp)
+		}
+
+		os.Exit(code)
+	}
+
+	if *otlpMetrics {
+		p, err := newOTLPMetricsPublisher(exporter)
+		if err != nil {
+			log.Fatalln("Error creating OTLP metrics exporter:", err)
+		}
+
+		exporter.Publishers = append(exporter.Publishers, p)
+	}
+
+	if *listenAddr != "" {
+		exporter.Stream = newStreamBroker(exporter)
+		exporter.Publishers = append(exporter.Publishers, exporter.Stream)
+	}
+
+	var w *remoteWriter
+
+	if *remoteWriteURL != "" {
+		var err error
+
+		w, err = newRemoteWriter(exporter)
+		if err != nil {
+			log.Fatalln("Error creating remote writer:", err)
+		}
+
+		go w.run(time.Duration(*remoteWriteInterval) * time.Second)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	polling := make(chan struct{})
+
+	go func() {
+		defer close(polling)
+
+		if *adaptive {
+			startAdaptivePolling(ctx, exporter)
+		} else {
+			startMetricsTicker(ctx, exporter, time.Duration(*interval)*time.Second)
+		}
+	}()
+
+	var srv *http.Server
+
+	// Without listen address the metrics are only pushed
+	if *listenAddr == "" {
+		log.Println("Starting power-datacenter Exporter without HTTP server")
+	} else {
+		srv = &http.Server{
+			Addr:    *listenAddr,
+			Handler: exporter.routes(),
+		}
+
+		log.Println("Starting power-datacenter Exporter at", *listenAddr)
+
+		go func() {
+			if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+				log.Fatalln("Error starting HTTP server:", err)
+			}
+		}()
+	}
+
+	<-ctx.Done()
+	stop()
+
+	log.Println("Shutting down power-datacenter Exporter")
+
+	shutdown(exporter, srv, w, tp, polling)
+}
+
+// Waits for a running poll to finish, so the publishers can flush the pending data, send
+// their offline status and close their connections, and the remote writer can push the
+// latest metrics. Closing the publishers also disconnects the event stream clients,
+// which the HTTP server would otherwise wait for.
+func shutdown(e *exporter, srv *http.Server, w *remoteWriter, tp *sdktrace.TracerProvider, polling <-chan struct{}) {
+	<-polling
+
+	e.closePublishers()
+
+	if w != nil {
+		w.close()
+	}
+
+	if srv != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Warnln("Error shutting down HTTP server:", err)
+		}
+	}
+
+	if tp != nil {
+		shutdownTracerProvider(tp)
 	}
 }
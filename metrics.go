@@ -0,0 +1,455 @@
+package main
+
+import (
+	"math"
+	"slices"
+
+	"github.com/marevers/power-datacenter-exporter/pkg/pdc"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// NamingLegacy names metrics with the line, string or output number in the name
+	NamingLegacy = "legacy"
+
+	// NamingStandard names metrics following the Prometheus naming conventions,
+	// with base units and the line, string or output number as label
+	NamingStandard = "standard"
+
+	// LabelLine represents the utility line number
+	LabelLine = "line"
+
+	// LabelString represents the PV input string number
+	LabelString = "string"
+
+	// LabelOutput represents the AC output number
+	LabelOutput = "output"
+
+	// GroupPowerFactor contains the derived power factor and reactive power gauges
+	GroupPowerFactor = "power-factor"
+)
+
+// gaugeDef describes a gauge that is set from the work info of a device
+type gaugeDef struct {
+	// Legacy is the name and LegacyHelp the help text in the legacy naming scheme,
+	// empty if the gauge was added after it and has its standard name in both schemes
+	Legacy     string
+	LegacyHelp string
+
+	// Name is the name and Help the help text in the standard naming scheme
+	Name string
+	Help string
+
+	// Dimension is the label that holds Index in the standard naming scheme,
+	// empty if the gauge is not numbered
+	Dimension string
+	Index     string
+
+	// Scale converts the value to the base unit of the standard naming scheme, 1 if zero
+	Scale float64
+
+	// Group is the optional group the gauge belongs to, empty if it is always registered
+	Group string
+
+	// Value returns the value from the work info, or NaN if there is none
+	Value func(wi *pdc.WorkInfo) float64
+}
+
+// gauge is a registered gauge and its definition
+type gauge struct {
+	gaugeDef
+	Vec *prometheus.GaugeVec
+	// Standard is true if the gauge is registered in the standard naming scheme
+	Standard bool
+}
+
+var gaugeDefs = []gaugeDef{
+	// Grid
+	{
+		Legacy: "grid1_frequency", LegacyHelp: "Grid 1 frequency in hertz",
+		Name: "grid_frequency_hertz", Help: "Grid frequency in hertz",
+		Dimension: LabelLine, Index: "1",
+		Value: func(wi *pdc.WorkInfo) float64 { return wi.GridFrequency1 },
+	},
+	{
+		Legacy: "grid2_frequency", LegacyHelp: "Grid 2 frequency in hertz",
+		Name: "grid_frequency_hertz", Help: "Grid frequency in hertz",
+		Dimension: LabelLine, Index: "2",
+		Value: func(wi *pdc.WorkInfo) float64 { return wi.GridFrequency2 },
+	},
+	{
+		Legacy: "grid1_voltage", LegacyHelp: "Grid 1 voltage",
+		Name: "grid_voltage_volts", Help: "Grid voltage in volts",
+		Dimension: LabelLine, Index: "1",
+		Value: func(wi *pdc.WorkInfo) float64 { return wi.GridVoltage1 },
+	},
+	{
+		Legacy: "grid2_voltage", LegacyHelp: "Grid 2 voltage",
+		Name: "grid_voltage_volts", Help: "Grid voltage in volts",
+		Dimension: LabelLine, Index: "2",
+		Value: func(wi *pdc.WorkInfo) float64 { return wi.GridVoltage2 },
+	},
+
+	// PV input
+	{
+		Legacy: "pvinput1_voltage", LegacyHelp: "PV input 1 voltage",
+		Name: "pv_input_voltage_volts", Help: "PV input voltage in volts",
+		Dimension: LabelString, Index: "1",
+		Value: func(wi *pdc.WorkInfo) float64 { return wi.PvInputVoltage1 },
+	},
+	{
+		Legacy: "pvinput2_voltage", LegacyHelp: "PV input 2 voltage",
+		Name: "pv_input_voltage_volts", Help: "PV input voltage in volts",
+		Dimension: LabelString, Index: "2",
+		Value: func(wi *pdc.WorkInfo) float64 { return wi.PvInputVoltage2 },
+	},
+	{
+		Legacy: "pvinput1_current", LegacyHelp: "PV input 1 current in amps",
+		Name: "pv_input_current_amperes", Help: "PV input current in amperes",
+		Dimension: LabelString, Index: "1",
+		Value: func(wi *pdc.WorkInfo) float64 { return wi.PvInputCurrent1 },
+	},
+	{
+		Legacy: "pvinput2_current", LegacyHelp: "PV input 2 current in amps",
+		Name: "pv_input_current_amperes", Help: "PV input current in amperes",
+		Dimension: LabelString, Index: "2",
+		Value: func(wi *pdc.WorkInfo) float64 { return wi.PvInputCurrent2 },
+	},
+
+	// AC output
+	{
+		Legacy: "acoutput1_voltage", LegacyHelp: "AC output 1 voltage",
+		Name: "ac_output_voltage_volts", Help: "AC output voltage in volts",
+		Dimension: LabelOutput, Index: "1",
+		Value: func(wi *pdc.WorkInfo) float64 { return wi.AcOutputVoltage1 },
+	},
+	{
+		Legacy: "acoutput2_voltage", LegacyHelp: "AC output 2 voltage",
+		Name: "ac_output_voltage_volts", Help: "AC output voltage in volts",
+		Dimension: LabelOutput, Index: "2",
+		Value: func(wi *pdc.WorkInfo) float64 { return wi.AcOutputVoltage2 },
+	},
+	{
+		Legacy: "acoutput1_frequency", LegacyHelp: "AC output 1 frequency in hertz",
+		Name: "ac_output_frequency_hertz", Help: "AC output frequency in hertz",
+		Dimension: LabelOutput, Index: "1",
+		Value: func(wi *pdc.WorkInfo) float64 { return wi.AcOutputFrequency1 },
+	},
+	{
+		Legacy: "acoutput2_frequency", LegacyHelp: "AC output 2 frequency in hertz",
+		Name: "ac_output_frequency_hertz", Help: "AC output frequency in hertz",
+		Dimension: LabelOutput, Index: "2",
+		Value: func(wi *pdc.WorkInfo) float64 { return wi.AcOutputFrequency2 },
+	},
+	{
+		Legacy: "acoutput1_apparent_power", LegacyHelp: "AC output 1 apparent power in volt-amps",
+		Name: "ac_output_apparent_power_volt_amperes", Help: "AC output apparent power in volt-amperes",
+		Dimension: LabelOutput, Index: "1",
+		Value: func(wi *pdc.WorkInfo) float64 { return wi.AcOutputApparentPower1 },
+	},
+	{
+		Legacy: "acoutput2_apparent_power", LegacyHelp: "AC output 2 apparent power in volt-amps",
+		Name: "ac_output_apparent_power_volt_amperes", Help: "AC output apparent power in volt-amperes",
+		Dimension: LabelOutput, Index: "2",
+		Value: func(wi *pdc.WorkInfo) float64 { return wi.AcOutputApparentPower2 },
+	},
+	{
+		Legacy: "acoutput1_active_power", LegacyHelp: "AC output 1 active power in watts",
+		Name: "ac_output_active_power_watts", Help: "AC output active power in watts",
+		Dimension: LabelOutput, Index: "1",
+		Value: func(wi *pdc.WorkInfo) float64 { return wi.AcOutputActivePower1 },
+	},
+	{
+		Legacy: "acoutput2_active_power", LegacyHelp: "AC output 2 active power in watts",
+		Name: "ac_output_active_power_watts", Help: "AC output active power in watts",
+		Dimension: LabelOutput, Index: "2",
+		Value: func(wi *pdc.WorkInfo) float64 { return wi.AcOutputActivePower2 },
+	},
+
+	// Output load
+	{
+		Legacy: "output1_load_percent", LegacyHelp: "Output 1 load in percentage",
+		Name: "output_load_ratio", Help: "Output load as ratio, 1 being full load",
+		Dimension: LabelOutput, Index: "1", Scale: 0.01,
+		Value: func(wi *pdc.WorkInfo) float64 { return wi.OutputLoadPercent1 },
+	},
+	{
+		Legacy: "output2_load_percent", LegacyHelp: "Output 2 load in percentage",
+		Name: "output_load_ratio", Help: "Output load as ratio, 1 being full load",
+		Dimension: LabelOutput, Index: "2", Scale: 0.01,
+		Value: func(wi *pdc.WorkInfo) float64 { return wi.OutputLoadPercent2 },
+	},
+
+	// Battery
+	{
+		Legacy: "battery_voltage", LegacyHelp: "Battery voltage",
+		Name: "battery_voltage_volts", Help: "Battery voltage in volts",
+		Value: func(wi *pdc.WorkInfo) float64 { return wi.BatVoltage },
+	},
+	{
+		Legacy: "battery_capacity_percent", LegacyHelp: "Battery capacity in percentage",
+		Name: "battery_capacity_ratio", Help: "Battery capacity as ratio from 0 to 1",
+		Scale: 0.01,
+		Value: func(wi *pdc.WorkInfo) float64 { return wi.BatCapacity },
+	},
+	{
+		Legacy: "battery_charge_current", LegacyHelp: "Battery charge current in amps",
+		Name: "battery_charge_current_amperes", Help: "Battery charge current in amperes",
+		Value: func(wi *pdc.WorkInfo) float64 { return wi.BatChgCurrent },
+	},
+	{
+		Legacy: "battery_discharge_current", LegacyHelp: "Battery discharge current in amps",
+		Name: "battery_discharge_current_amperes", Help: "Battery discharge current in amperes",
+		Value: func(wi *pdc.WorkInfo) float64 { return wi.BatDischgCurrent },
+	},
+
+	// Totals
+	{
+		Legacy: "total_pvinput_power", LegacyHelp: "Total PV input power in watts",
+		Name: "total_pv_input_power_watts", Help: "Total PV input power in watts",
+		Value: func(wi *pdc.WorkInfo) float64 { return wi.TotalPvInputPower },
+	},
+	{
+		Legacy: "total_output_load_percent", LegacyHelp: "Total output load in percentage",
+		Name: "total_output_load_ratio", Help: "Total output load as ratio, 1 being full load",
+		Scale: 0.01,
+		Value: func(wi *pdc.WorkInfo) float64 { return wi.TotalOutputLoadPercent },
+	},
+	{
+		Legacy: "total_battery_charge_current", LegacyHelp: "Total battery charge current in amps",
+		Name: "total_battery_charge_current_amperes", Help: "Total battery charge current in amperes",
+		Value: func(wi *pdc.WorkInfo) float64 { return wi.TotalBatChgCurrent },
+	},
+	{
+		Legacy: "total_acoutput_apparent_power", LegacyHelp: "Total AC output apparent power in volt-amps",
+		Name: "total_ac_output_apparent_power_volt_amperes", Help: "Total AC output apparent power in volt-amperes",
+		Value: func(wi *pdc.WorkInfo) float64 { return wi.TotalAcOutputApparentPower },
+	},
+	{
+		Legacy: "total_acoutput_active_power", LegacyHelp: "Total AC output active power in watts",
+		Name: "total_ac_output_active_power_watts", Help: "Total AC output active power in watts",
+		Value: func(wi *pdc.WorkInfo) float64 { return wi.TotalAcOutputActivePower },
+	},
+
+	// Derived
+	{
+		Name: "pv_input_power_watts", Help: "PV input power in watts, calculated from voltage and current",
+		Dimension: LabelString, Index: "1",
+		Value: func(wi *pdc.WorkInfo) float64 { return wi.PvInputVoltage1 * wi.PvInputCurrent1 },
+	},
+	{
+		Name: "pv_input_power_watts", Help: "PV input power in watts, calculated from voltage and current",
+		Dimension: LabelString, Index: "2",
+		Value: func(wi *pdc.WorkInfo) float64 { return wi.PvInputVoltage2 * wi.PvInputCurrent2 },
+	},
+	{
+		Name: "battery_power_watts", Help: "Battery power in watts, positive when charging and negative when discharging",
+		Value: batteryPower,
+	},
+	{
+		Name: "inverter_efficiency_ratio", Help: "Estimated inverter efficiency as ratio, AC output active power versus PV and battery discharge power",
+		Value: inverterEfficiency,
+	},
+
+	// Power factor and reactive power
+	{
+		Name: "ac_output_power_factor", Help: "AC output power factor, active power versus apparent power",
+		Dimension: LabelOutput, Index: "1", Group: GroupPowerFactor,
+		Value: func(wi *pdc.WorkInfo) float64 { return powerFactor(wi.AcOutputActivePower1, wi.AcOutputApparentPower1) },
+	},
+	{
+		Name: "ac_output_power_factor", Help: "AC output power factor, active power versus apparent power",
+		Dimension: LabelOutput, Index: "2", Group: GroupPowerFactor,
+		Value: func(wi *pdc.WorkInfo) float64 { return powerFactor(wi.AcOutputActivePower2, wi.AcOutputApparentPower2) },
+	},
+	{
+		Name: "total_ac_output_power_factor", Help: "Total AC output power factor, active power versus apparent power",
+		Group: GroupPowerFactor,
+		Value: func(wi *pdc.WorkInfo) float64 {
+			return powerFactor(wi.TotalAcOutputActivePower, wi.TotalAcOutputApparentPower)
+		},
+	},
+	{
+		Name: "ac_output_reactive_power_volt_amperes_reactive", Help: "AC output reactive power in volt-amperes reactive",
+		Dimension: LabelOutput, Index: "1", Group: GroupPowerFactor,
+		Value: func(wi *pdc.WorkInfo) float64 {
+			return reactivePower(wi.AcOutputActivePower1, wi.AcOutputApparentPower1)
+		},
+	},
+	{
+		Name: "ac_output_reactive_power_volt_amperes_reactive", Help: "AC output reactive power in volt-amperes reactive",
+		Dimension: LabelOutput, Index: "2", Group: GroupPowerFactor,
+		Value: func(wi *pdc.WorkInfo) float64 {
+			return reactivePower(wi.AcOutputActivePower2, wi.AcOutputApparentPower2)
+		},
+	},
+	{
+		Name: "total_ac_output_reactive_power_volt_amperes_reactive", Help: "Total AC output reactive power in volt-amperes reactive",
+		Group: GroupPowerFactor,
+		Value: func(wi *pdc.WorkInfo) float64 {
+			return reactivePower(wi.TotalAcOutputActivePower, wi.TotalAcOutputApparentPower)
+		},
+	},
+
+	// Boolean statuses
+	{
+		Legacy: "hasload1", LegacyHelp: "Returns 1 if output 1 has load",
+		Name: "has_load", Help: "Returns 1 if the output has load",
+		Dimension: LabelOutput, Index: "1",
+		Value: func(wi *pdc.WorkInfo) float64 { return convertBoolToFloat(wi.HasLoad1) },
+	},
+	{
+		Legacy: "hasload2", LegacyHelp: "Returns 1 if output 2 has load",
+		Name: "has_load", Help: "Returns 1 if the output has load",
+		Dimension: LabelOutput, Index: "2",
+		Value: func(wi *pdc.WorkInfo) float64 { return convertBoolToFloat(wi.HasLoad2) },
+	},
+	{
+		Legacy: "acchargeon1", LegacyHelp: "Returns 1 if line 1 is being charged with utility power",
+		Name: "ac_charge_on", Help: "Returns 1 if the line is being charged with utility power",
+		Dimension: LabelLine, Index: "1",
+		Value: func(wi *pdc.WorkInfo) float64 { return convertBoolToFloat(wi.ACchargeOn1) },
+	},
+	{
+		Legacy: "acchargeon2", LegacyHelp: "Returns 1 if line 2 is being charged with utility power",
+		Name: "ac_charge_on", Help: "Returns 1 if the line is being charged with utility power",
+		Dimension: LabelLine, Index: "2",
+		Value: func(wi *pdc.WorkInfo) float64 { return convertBoolToFloat(wi.ACchargeOn2) },
+	},
+	{
+		Legacy: "sccchargeon1", LegacyHelp: "Returns 1 if line 1 is being charged with solar power",
+		Name: "scc_charge_on", Help: "Returns 1 if the line is being charged with solar power",
+		Dimension: LabelLine, Index: "1",
+		Value: func(wi *pdc.WorkInfo) float64 { return convertBoolToFloat(wi.SCCchargeOn1) },
+	},
+	{
+		Legacy: "sccchargeon2", LegacyHelp: "Returns 1 if line 2 is being charged with solar power",
+		Name: "scc_charge_on", Help: "Returns 1 if the line is being charged with solar power",
+		Dimension: LabelLine, Index: "2",
+		Value: func(wi *pdc.WorkInfo) float64 { return convertBoolToFloat(wi.SCCchargeOn2) },
+	},
+	{
+		Legacy: "lineloss1", LegacyHelp: "Returns 1 if utility line 1 is offline",
+		Name: "line_loss", Help: "Returns 1 if the utility line is offline",
+		Dimension: LabelLine, Index: "1",
+		Value: func(wi *pdc.WorkInfo) float64 { return convertBoolToFloat(wi.LineLoss1) },
+	},
+	{
+		Legacy: "lineloss2", LegacyHelp: "Returns 1 if utility line 2 is offline",
+		Name: "line_loss", Help: "Returns 1 if the utility line is offline",
+		Dimension: LabelLine, Index: "2",
+		Value: func(wi *pdc.WorkInfo) float64 { return convertBoolToFloat(wi.LineLoss2) },
+	},
+	{
+		Legacy: "overload", LegacyHelp: "Returns 1 if system is overloaded",
+		Name: "overload", Help: "Returns 1 if system is overloaded",
+		Value: func(wi *pdc.WorkInfo) float64 { return convertBoolToFloat(wi.OverLoad) },
+	},
+}
+
+// Returns the battery power in watts, positive when charging and negative when discharging.
+func batteryPower(wi *pdc.WorkInfo) float64 {
+	return wi.BatVoltage * (wi.BatChgCurrent - wi.BatDischgCurrent)
+}
+
+// Returns the estimated inverter efficiency as ratio, or NaN if there is
+// no input power or the output exceeds it, e.g. when loads are powered by the grid.
+func inverterEfficiency(wi *pdc.WorkInfo) float64 {
+	in := wi.TotalPvInputPower + wi.BatVoltage*wi.BatDischgCurrent
+	if in <= 0 || wi.TotalAcOutputActivePower > in {
+		return math.NaN()
+	}
+
+	return wi.TotalAcOutputActivePower / in
+}
+
+// Returns the power factor from active and apparent power,
+// or NaN if there is no load. Rounding errors are capped at 1.
+func powerFactor(active, apparent float64) float64 {
+	if apparent <= 0 {
+		return math.NaN()
+	}
+
+	return math.Min(math.Abs(active)/apparent, 1)
+}
+
+// Returns the reactive power from active and apparent power,
+// or NaN if there is no load. Rounding errors are capped at 0.
+func reactivePower(active, apparent float64) float64 {
+	if apparent <= 0 {
+		return math.NaN()
+	}
+
+	return math.Sqrt(math.Max(apparent*apparent-active*active, 0))
+}
+
+// Registers the gauges of all definitions in the given naming scheme with the registerer, except those in disabled groups.
+// With legacy set, the legacy names are registered as well when using the standard naming scheme.
+func (e *exporter) registerGauges(reg prometheus.Registerer, labels []string, naming string, legacy bool, disabled []string) {
+	standardVecs := map[string]*prometheus.GaugeVec{}
+
+	for _, def := range gaugeDefs {
+		if def.Group != "" && slices.Contains(disabled, def.Group) {
+			continue
+		}
+
+		if def.Legacy != "" && (naming == NamingLegacy || legacy && def.Legacy != def.Name) {
+			e.Metrics.Gauges = append(e.Metrics.Gauges, gauge{
+				gaugeDef: def,
+				Vec: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+					Name:      def.Legacy,
+					Namespace: Namespace,
+					Help:      def.LegacyHelp,
+				}, labels),
+			})
+		}
+
+		if naming != NamingStandard && def.Legacy != "" {
+			continue
+		}
+
+		// Numbered definitions share a single vector in the standard naming scheme
+		vec, ok := standardVecs[def.Name]
+		if !ok {
+			l := labels
+			if def.Dimension != "" {
+				l = append(slices.Clone(labels), def.Dimension)
+			}
+
+			vec = promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+				Name:      def.Name,
+				Namespace: Namespace,
+				Help:      def.Help,
+			}, l)
+
+			standardVecs[def.Name] = vec
+		}
+
+		e.Metrics.Gauges = append(e.Metrics.Gauges, gauge{
+			gaugeDef: def,
+			Vec:      vec,
+			Standard: true,
+		})
+	}
+}
+
+// Sets the gauge from the given work info, or deletes it if there is no value.
+func (g *gauge) set(labelValues []string, wi *pdc.WorkInfo) {
+	if g.Standard && g.Dimension != "" {
+		labelValues = append(slices.Clone(labelValues), g.Index)
+	}
+
+	v := g.Value(wi)
+
+	if math.IsNaN(v) {
+		g.Vec.DeleteLabelValues(labelValues...)
+		return
+	}
+
+	if g.Standard && g.Scale != 0 {
+		v *= g.Scale
+	}
+
+	g.Vec.WithLabelValues(labelValues...).Set(v)
+}
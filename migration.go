@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+)
+
+//go:generate sh -c "go run . -metrics.print-migration > docs/metrics-migration.md"
+//go:generate sh -c "go run . -metrics.print-legacy-rules > examples/legacy-rules.yml"
+
+// Writes a markdown table mapping the legacy metric names to the standard ones.
+func writeMigrationTable(w io.Writer) {
+	fmt.Fprintln(w, "# Metric migration")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "<!-- Generated by `go generate`, do not edit. -->")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Metric names in the `legacy` naming scheme and their replacement in the `standard` naming scheme (`-metrics.naming=standard`).")
+	fmt.Fprintln(w, "Metrics that are not listed have the same name in both schemes. The recording rules in [examples/legacy-rules.yml](../examples/legacy-rules.yml) produce the legacy names from the standard ones.")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "| Legacy name | Standard name | Conversion |")
+	fmt.Fprintln(w, "| --- | --- | --- |")
+
+	for _, def := range gaugeDefs {
+		if def.Legacy == "" || def.Legacy == def.Name {
+			continue
+		}
+
+		name := Namespace + "_" + def.Name
+		if def.Dimension != "" {
+			name += fmt.Sprintf(`{%v="%v"}`, def.Dimension, def.Index)
+		}
+
+		conversion := ""
+		if def.Scale != 0 {
+			conversion = "× " + strconv.FormatFloat(def.Scale, 'g', -1, 64)
+		}
+
+		fmt.Fprintf(w, "| `%v_%v` | `%v` | %v |\n", Namespace, def.Legacy, name, conversion)
+	}
+}
+
+// Writes Prometheus recording rules that produce the legacy metric names from the standard ones.
+func writeLegacyRules(w io.Writer) {
+	fmt.Fprintln(w, "# Generated by `go generate`, do not edit.")
+	fmt.Fprintln(w, "# Recording rules producing the legacy metric names from the standard naming scheme.")
+	fmt.Fprintln(w, "groups:")
+	fmt.Fprintln(w, "  - name: pdc-legacy-names")
+	fmt.Fprintln(w, "    rules:")
+
+	for _, def := range gaugeDefs {
+		if def.Legacy == "" || def.Legacy == def.Name {
+			continue
+		}
+
+		expr := Namespace + "_" + def.Name
+		if def.Dimension != "" {
+			expr = fmt.Sprintf(`max without (%v) (%v{%v="%v"})`, def.Dimension, expr, def.Dimension, def.Index)
+		}
+
+		if def.Scale != 0 {
+			expr += " * " + strconv.FormatFloat(1/def.Scale, 'g', -1, 64)
+		}
+
+		fmt.Fprintf(w, "      - record: %v_%v\n", Namespace, def.Legacy)
+		fmt.Fprintf(w, "        expr: '%v'\n", expr)
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Maximum time to wait for the broker when connecting and publishing
+	mqttTimeout = 10 * time.Second
+
+	// Payloads of the availability topic
+	mqttOnline  = "online"
+	mqttOffline = "offline"
+)
+
+// mqttMessage is a message to publish
+type mqttMessage struct {
+	Topic   string
+	Payload []byte
+	Retain  bool
+}
+
+// mqttPublisher publishes the work info of every device to an MQTT broker,
+// both as JSON document on <prefix>/<serial> and per field on <prefix>/<serial>/<field>
+type mqttPublisher struct {
+	Client mqtt.Client
+	Prefix string
+	QoS    byte
+	Retain bool
+
+	// Last are the most recent messages by serial number, which are republished after reconnecting
+	Last map[string][]mqttMessage
+	// Discovery are the Home Assistant discovery configs by serial number
+	Discovery map[string][]mqttMessage
+	mu        sync.Mutex
+
+	Connected     prometheus.Gauge
+	PublishErrors prometheus.Counter
+}
+
+// Returns a publisher for the broker configured by the mqtt flags and connects to it.
+// Connection failures are retried in the background.
+func newMQTTPublisher(reg prometheus.Registerer) (*mqttPublisher, error) {
+	if *mqttQoS > 2 {
+		return nil, fmt.Errorf("invalid MQTT QoS: %d", *mqttQoS)
+	}
+
+	p := &mqttPublisher{
+		Prefix:    *mqttTopicPrefix,
+		QoS:       byte(*mqttQoS),
+		Retain:    *mqttRetain,
+		Last:      map[string][]mqttMessage{},
+		Discovery: map[string][]mqttMessage{},
+	}
+
+	p.Connected = promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+		Name:      "mqtt_connected",
+		Namespace: Namespace,
+		Help:      "Returns 1 if the exporter is connected to the MQTT broker",
+	})
+
+	p.PublishErrors = promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name:      "mqtt_publish_errors_total",
+		Namespace: Namespace,
+		Help:      "Number of messages that could not be published to the MQTT broker",
+	})
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(*mqttBroker).
+		SetClientID(*mqttClientID).
+		SetUsername(*mqttUsername).
+		SetPassword(*mqttPassword).
+		SetConnectTimeout(mqttTimeout).
+		SetWriteTimeout(mqttTimeout).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(mqttTimeout).
+		SetMaxReconnectInterval(time.Minute).
+		SetWill(p.availabilityTopic(), mqttOffline, p.QoS, true).
+		SetOnConnectHandler(p.onConnect).
+		SetConnectionLostHandler(p.onConnectionLost)
+
+	if *mqttTLSCAFile != "" || *mqttTLSCertFile != "" || *mqttTLSInsecureSkipVerify {
+		tlsConfig, err := mqttTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+
+		opts.SetTLSConfig(tlsConfig)
+	}
+
+	p.Client = mqtt.NewClient(opts)
+
+	if t := p.Client.Connect(); !t.WaitTimeout(mqttTimeout) {
+		log.Warnln("Not connected to MQTT broker", *mqttBroker, "yet, retrying in the background")
+	}
+
+	return p, nil
+}
+
+// Returns the TLS configuration from the mqtt.tls flags.
+func mqttTLSConfig() (*tls.Config, error) {
+	c := &tls.Config{
+		InsecureSkipVerify: *mqttTLSInsecureSkipVerify,
+	}
+
+	if *mqttTLSCAFile != "" {
+		b, err := os.ReadFile(*mqttTLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		c.RootCAs = x509.NewCertPool()
+
+		if !c.RootCAs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificates found in %s", *mqttTLSCAFile)
+		}
+	}
+
+	if *mqttTLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(*mqttTLSCertFile, *mqttTLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		c.Certificates = []tls.Certificate{cert}
+	}
+
+	return c, nil
+}
+
+// Returns the topic the exporter publishes whether it is online to.
+func (p *mqttPublisher) availabilityTopic() string {
+	return p.Prefix + "/status"
+}
+
+func (p *mqttPublisher) onConnect(c mqtt.Client) {
+	log.Infoln("Connected to MQTT broker", *mqttBroker)
+	p.Connected.Set(1)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.send([]mqttMessage{{Topic: p.availabilityTopic(), Payload: []byte(mqttOnline), Retain: true}})
+
+	// Messages of polls while disconnected were dropped, so publish the latest ones again
+	for serial, msgs := range p.Last {
+		p.send(p.Discovery[serial])
+		p.send(msgs)
+	}
+}
+
+func (p *mqttPublisher) onConnectionLost(c mqtt.Client, err error) {
+	log.Warnln("Connection to MQTT broker lost:", err)
+	p.Connected.Set(0)
+}
+
+func (p *mqttPublisher) publish(d *device) {
+	base := p.Prefix + "/" + d.SerialNumber
+
+	fields := workInfoFields(&d.WorkInfo)
+
+	if t := d.WorkInfo.SampleTime(); !t.IsZero() {
+		fields = append(fields, field{Name: "timestamp", Value: float64(t.Unix())})
+	}
+
+	doc := map[string]any{}
+	msgs := make([]mqttMessage, 0, len(fields)+1)
+
+	for _, f := range fields {
+		doc[f.Name] = f.Value
+		msgs = append(msgs, mqttMessage{Topic: base + "/" + f.Name, Payload: []byte(formatFieldValue(f.Value)), Retain: p.Retain})
+	}
+
+	b, err := json.Marshal(doc)
+	if err != nil {
+		log.Warnln("Error encoding MQTT message:", err)
+		return
+	}
+
+	msgs = append(msgs, mqttMessage{Topic: base, Payload: b, Retain: p.Retain})
+
+	var discovery []mqttMessage
+
+	if *mqttHomeAssistant {
+		discovery = p.discoveryMessages(d, fields)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Discovery configs are retained, so they are only published again if they changed
+	discoveryChanged := !slices.EqualFunc(discovery, p.Discovery[d.SerialNumber], func(a, b mqttMessage) bool {
+		return a.Topic == b.Topic && bytes.Equal(a.Payload, b.Payload)
+	})
+
+	p.Last[d.SerialNumber] = msgs
+	p.Discovery[d.SerialNumber] = discovery
+
+	if !p.Client.IsConnectionOpen() {
+		log.Debugln("Not connected to MQTT broker, skipped publishing", d.SerialNumber)
+		return
+	}
+
+	if discoveryChanged {
+		p.send(discovery)
+	}
+
+	p.send(msgs)
+}
+
+// Forgets the messages of the device, so they are not published again after reconnecting,
+// and clears its retained messages so that Home Assistant removes its entities.
+func (p *mqttPublisher) remove(serial string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	msgs := slices.Concat(p.Discovery[serial], p.Last[serial])
+
+	delete(p.Last, serial)
+	delete(p.Discovery, serial)
+
+	if len(msgs) == 0 {
+		return
+	}
+
+	if !p.Client.IsConnectionOpen() {
+		log.Warnln("Not connected to MQTT broker, retained messages of", serial, "are not cleared")
+		return
+	}
+
+	// An empty retained message deletes the retained message of the topic
+	cleared := make([]mqttMessage, 0, len(msgs))
+
+	for _, m := range msgs {
+		cleared = append(cleared, mqttMessage{Topic: m.Topic, Payload: []byte{}, Retain: true})
+	}
+
+	p.send(cleared)
+}
+
+// Publishes the messages and waits until they were sent.
+func (p *mqttPublisher) send(msgs []mqttMessage) {
+	tokens := make([]mqtt.Token, 0, len(msgs))
+
+	for _, m := range msgs {
+		tokens = append(tokens, p.Client.Publish(m.Topic, p.QoS, m.Retain, m.Payload))
+	}
+
+	deadline := time.Now().Add(mqttTimeout)
+
+	var errs []error
+
+	for _, t := range tokens {
+		if !t.WaitTimeout(time.Until(deadline)) {
+			errs = append(errs, errors.New("timeout"))
+		} else if err := t.Error(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		p.PublishErrors.Add(float64(len(errs)))
+		log.Warnf("Error publishing %d of %d MQTT messages: %v", len(errs), len(msgs), errs[0])
+	}
+}
+
+func (p *mqttPublisher) close() {
+	// The will is only published if the connection is lost, not on disconnecting
+	if p.Client.IsConnectionOpen() {
+		p.Client.Publish(p.availabilityTopic(), p.QoS, true, mqttOffline).WaitTimeout(mqttTimeout)
+	}
+
+	p.Client.Disconnect(250)
+}
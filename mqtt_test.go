@@ -0,0 +1,474 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/marevers/power-datacenter-exporter/pkg/pdc"
+	broker "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Sets the flag to v for the duration of the test.
+func setFlag[T any](t *testing.T, p *T, v T) {
+	t.Helper()
+
+	old := *p
+	*p = v
+
+	t.Cleanup(func() { *p = old })
+}
+
+// Returns a device with a work info sampled at 2024-06-01 12:35:07 UTC.
+func testDevice() *device {
+	d := &device{
+		Device:      pdc.Device{SerialNumber: "92632105100000", Name: "Garage", MachineType: "MKS2-5600"},
+		LabelValues: []string{"92632105100000"},
+		Retrieved:   time.Date(2024, 6, 1, 12, 35, 30, 0, time.UTC),
+	}
+
+	d.WorkInfo = pdc.WorkInfo{
+		SerialNo:     "92632105100000",
+		GridVoltage1: 231.4,
+		BatVoltage:   52.6,
+		BatCapacity:  87,
+		ChargeSource: "PV",
+		WorkMode:     "Battery Mode",
+		HasLoad1:     true,
+		ACchargeOn1:  false,
+		Timestr:      "2024-06-01 14:35:07",
+		DataID:       89619160,
+	}
+	d.WorkInfo.Time.Time = 1717245307000
+
+	return d
+}
+
+// testBroker is an embedded MQTT broker recording every message published to it
+type testBroker struct {
+	broker.HookBase
+
+	Server *broker.Server
+	URL    string
+
+	mu       sync.Mutex
+	messages []packets.Packet
+	received chan struct{}
+}
+
+func newTestBroker(t *testing.T) *testBroker {
+	t.Helper()
+
+	b := &testBroker{
+		Server:   broker.New(&broker.Options{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}),
+		received: make(chan struct{}, 1),
+	}
+
+	if err := b.Server.AddHook(new(auth.AllowHook), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Server.AddHook(b, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	l := listeners.NewTCP(listeners.Config{ID: "test", Address: "127.0.0.1:0"})
+	if err := b.Server.AddListener(l); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Server.Serve(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { b.Server.Close() })
+
+	b.URL = "tcp://" + l.Address()
+
+	return b
+}
+
+func (b *testBroker) ID() string {
+	return "recorder"
+}
+
+func (b *testBroker) Provides(hook byte) bool {
+	return hook == broker.OnPublished || hook == broker.OnWillSent
+}
+
+func (b *testBroker) OnPublished(cl *broker.Client, pk packets.Packet) {
+	b.record(pk)
+}
+
+func (b *testBroker) OnWillSent(cl *broker.Client, pk packets.Packet) {
+	b.record(pk)
+}
+
+func (b *testBroker) record(pk packets.Packet) {
+	b.mu.Lock()
+	b.messages = append(b.messages, pk)
+	b.mu.Unlock()
+
+	select {
+	case b.received <- struct{}{}:
+	default:
+	}
+}
+
+// Waits until n messages were published to the topic and returns the last one.
+func (b *testBroker) wait(t *testing.T, topic string, n int) packets.Packet {
+	t.Helper()
+
+	timeout := time.After(10 * time.Second)
+
+	for {
+		var (
+			count int
+			last  packets.Packet
+		)
+
+		b.mu.Lock()
+
+		for _, pk := range b.messages {
+			if pk.TopicName == topic {
+				count++
+				last = pk
+			}
+		}
+
+		b.mu.Unlock()
+
+		if count >= n {
+			return last
+		}
+
+		select {
+		case <-b.received:
+		case <-timeout:
+			t.Fatalf("received %d messages on %s, want %d", count, topic, n)
+		}
+	}
+}
+
+// Returns the number of messages published to the topic.
+func (b *testBroker) count(topic string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n := 0
+
+	for _, pk := range b.messages {
+		if pk.TopicName == topic {
+			n++
+		}
+	}
+
+	return n
+}
+
+// Starts a publisher connected to a new test broker.
+func newTestMQTTPublisher(t *testing.T) (*mqttPublisher, *testBroker) {
+	t.Helper()
+
+	b := newTestBroker(t)
+
+	setFlag(t, mqttBroker, b.URL)
+	setFlag(t, mqttClientID, "pdc-test")
+	setFlag(t, mqttTopicPrefix, "pdc")
+	setFlag(t, mqttQoS, 1)
+	setFlag(t, mqttRetain, true)
+
+	p, err := newMQTTPublisher(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { p.Client.Disconnect(0) })
+
+	return p, b
+}
+
+func TestMQTTPublish(t *testing.T) {
+	p, b := newTestMQTTPublisher(t)
+
+	if pk := b.wait(t, "pdc/status", 1); string(pk.Payload) != mqttOnline || !pk.FixedHeader.Retain {
+		t.Errorf("availability = %s retained %v, want %s retained", pk.Payload, pk.FixedHeader.Retain, mqttOnline)
+	}
+
+	d := testDevice()
+	p.publish(d)
+
+	pk := b.wait(t, "pdc/92632105100000", 1)
+
+	if pk.FixedHeader.Qos != 1 || !pk.FixedHeader.Retain {
+		t.Errorf("JSON message QoS %d retained %v, want QoS 1 retained", pk.FixedHeader.Qos, pk.FixedHeader.Retain)
+	}
+
+	var doc map[string]any
+	if err := json.Unmarshal(pk.Payload, &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	for k, want := range map[string]any{
+		"serial_no":       "92632105100000",
+		"battery_voltage": 52.6,
+		"work_mode":       "Battery Mode",
+		"has_load":        true,
+		"ac_charge_on":    false,
+		"timestamp":       float64(1717245307),
+	} {
+		if doc[k] != want {
+			t.Errorf("JSON %s = %v, want %v", k, doc[k], want)
+		}
+	}
+
+	for topic, want := range map[string]string{
+		"pdc/92632105100000/battery_voltage":  "52.6",
+		"pdc/92632105100000/battery_capacity": "87",
+		"pdc/92632105100000/work_mode":        "Battery Mode",
+		"pdc/92632105100000/has_load":         "true",
+		"pdc/92632105100000/line_loss":        "false",
+		"pdc/92632105100000/timestamp":        "1717245307",
+	} {
+		pk := b.wait(t, topic, 1)
+
+		if string(pk.Payload) != want {
+			t.Errorf("%s = %s, want %s", topic, pk.Payload, want)
+		}
+
+		if pk.FixedHeader.Qos != 1 || !pk.FixedHeader.Retain {
+			t.Errorf("%s QoS %d retained %v, want QoS 1 retained", topic, pk.FixedHeader.Qos, pk.FixedHeader.Retain)
+		}
+	}
+
+	if n := b.count("homeassistant/sensor/pdc_92632105100000/battery_voltage/config"); n != 0 {
+		t.Errorf("published %d discovery configs without Home Assistant enabled", n)
+	}
+
+	p.close()
+
+	if pk := b.wait(t, "pdc/status", 2); string(pk.Payload) != mqttOffline || !pk.FixedHeader.Retain {
+		t.Errorf("availability after closing = %s retained %v, want %s retained", pk.Payload, pk.FixedHeader.Retain, mqttOffline)
+	}
+}
+
+func TestMQTTReconnect(t *testing.T) {
+	p, b := newTestMQTTPublisher(t)
+
+	b.wait(t, "pdc/status", 1)
+
+	p.publish(testDevice())
+	b.wait(t, "pdc/92632105100000", 1)
+
+	// Dropping the connection makes the broker publish the will
+	cl, ok := b.Server.Clients.Get("pdc-test")
+	if !ok {
+		t.Fatal("publisher is not connected")
+	}
+
+	cl.Stop(errors.New("test"))
+
+	if pk := b.wait(t, "pdc/status", 2); string(pk.Payload) != mqttOffline || !pk.FixedHeader.Retain {
+		t.Errorf("will = %s retained %v, want %s retained", pk.Payload, pk.FixedHeader.Retain, mqttOffline)
+	}
+
+	// The publisher comes back online and publishes the latest messages again
+	if pk := b.wait(t, "pdc/status", 3); string(pk.Payload) != mqttOnline {
+		t.Errorf("availability after reconnecting = %s, want %s", pk.Payload, mqttOnline)
+	}
+
+	b.wait(t, "pdc/92632105100000", 2)
+	b.wait(t, "pdc/92632105100000/battery_voltage", 2)
+}
+
+func TestMQTTRemove(t *testing.T) {
+	p, b := newTestMQTTPublisher(t)
+
+	setFlag(t, mqttHomeAssistant, true)
+	setFlag(t, mqttHomeAssistantPrefix, "homeassistant")
+
+	b.wait(t, "pdc/status", 1)
+
+	p.publish(testDevice())
+
+	topics := []string{
+		"homeassistant/sensor/pdc_92632105100000/battery_voltage/config",
+		"pdc/92632105100000",
+		"pdc/92632105100000/battery_voltage",
+	}
+
+	for _, topic := range topics {
+		b.wait(t, topic, 1)
+	}
+
+	p.remove("92632105100000")
+
+	for _, topic := range topics {
+		if pk := b.wait(t, topic, 2); len(pk.Payload) != 0 || !pk.FixedHeader.Retain {
+			t.Errorf("%s after removing = %q retained %v, want empty retained", topic, pk.Payload, pk.FixedHeader.Retain)
+		}
+
+		if msgs := b.Server.Topics.Messages(topic); len(msgs) != 0 {
+			t.Errorf("%s retains %d messages after removing, want none", topic, len(msgs))
+		}
+	}
+
+	if len(p.Last) != 0 || len(p.Discovery) != 0 {
+		t.Errorf("messages after removing = %d, discovery configs = %d, want none", len(p.Last), len(p.Discovery))
+	}
+
+	// Removing an unknown device publishes nothing
+	p.remove("92632105100000")
+
+	// Reconnecting publishes the availability, but not the messages of the removed device
+	cl, ok := b.Server.Clients.Get("pdc-test")
+	if !ok {
+		t.Fatal("publisher is not connected")
+	}
+
+	cl.Stop(errors.New("test"))
+
+	b.wait(t, "pdc/status", 3)
+
+	// Publishing waits until the latest messages were published again after connecting
+	d := testDevice()
+	d.SerialNumber = "1"
+	p.publish(d)
+	b.wait(t, "pdc/1", 1)
+
+	for _, topic := range topics {
+		if n := b.count(topic); n != 2 {
+			t.Errorf("published %d messages on %s, want 2", n, topic)
+		}
+	}
+}
+
+func TestMQTTDiscoveryMessages(t *testing.T) {
+	setFlag(t, mqttHomeAssistantPrefix, "homeassistant")
+
+	p := &mqttPublisher{Prefix: "pdc"}
+
+	d := testDevice()
+	fields := append(workInfoFields(&d.WorkInfo), field{Name: "timestamp", Value: float64(1717245307)})
+
+	msgs := p.discoveryMessages(d, fields)
+
+	configs := map[string]haConfig{}
+
+	for _, m := range msgs {
+		if !m.Retain {
+			t.Errorf("discovery config %s is not retained", m.Topic)
+		}
+
+		var c haConfig
+		if err := json.Unmarshal(m.Payload, &c); err != nil {
+			t.Fatal(err)
+		}
+
+		configs[m.Topic] = c
+	}
+
+	if len(configs) != len(haEntities) {
+		t.Errorf("got %d discovery configs, want one for each of the %d entities", len(configs), len(haEntities))
+	}
+
+	dev := haDevice{Identifiers: []string{"pdc_92632105100000"}, Name: "Garage", Model: "MKS2-5600", SerialNumber: "92632105100000"}
+
+	tests := []struct {
+		topic string
+		want  haConfig
+	}{
+		{
+			topic: "homeassistant/sensor/pdc_92632105100000/battery_voltage/config",
+			want: haConfig{
+				Name: "Battery voltage", UniqueID: "pdc_92632105100000_battery_voltage",
+				StateTopic: "pdc/92632105100000/battery_voltage", AvailabilityTopic: "pdc/status",
+				DeviceClass: "voltage", StateClass: "measurement", Unit: "V", Device: dev,
+			},
+		},
+		{
+			topic: "homeassistant/binary_sensor/pdc_92632105100000/line_loss/config",
+			want: haConfig{
+				Name: "Grid 1 lost", UniqueID: "pdc_92632105100000_line_loss",
+				StateTopic: "pdc/92632105100000/line_loss", AvailabilityTopic: "pdc/status",
+				DeviceClass: "problem", PayloadOn: "true", PayloadOff: "false", Device: dev,
+			},
+		},
+		{
+			topic: "homeassistant/sensor/pdc_92632105100000/data_id/config",
+			want: haConfig{
+				Name: "Data ID", UniqueID: "pdc_92632105100000_data_id",
+				StateTopic: "pdc/92632105100000/data_id", AvailabilityTopic: "pdc/status",
+				EntityCategory: "diagnostic", Device: dev,
+			},
+		},
+		{
+			topic: "homeassistant/sensor/pdc_92632105100000/timestamp/config",
+			want: haConfig{
+				Name: "Sample time", UniqueID: "pdc_92632105100000_timestamp",
+				StateTopic: "pdc/92632105100000/timestamp", AvailabilityTopic: "pdc/status",
+				DeviceClass: "timestamp", ValueTemplate: haEntities["timestamp"].ValueTemplate, Device: dev,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		got, ok := configs[tt.topic]
+		if !ok {
+			t.Errorf("no discovery config on %s", tt.topic)
+			continue
+		}
+
+		a, _ := json.Marshal(got)
+		b, _ := json.Marshal(tt.want)
+
+		if !bytes.Equal(a, b) {
+			t.Errorf("%s = %s, want %s", tt.topic, a, b)
+		}
+	}
+
+	// Devices without name are named by their serial number
+	d.Name = ""
+
+	var c haConfig
+	if err := json.Unmarshal(p.discoveryMessages(d, fields[:1])[0].Payload, &c); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Device.Name != d.SerialNumber {
+		t.Errorf("device name = %s, want %s", c.Device.Name, d.SerialNumber)
+	}
+}
+
+func TestPortalNameToSnakeCase(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"serialNo", "serial_no"},
+		{"gridVoltage2", "grid_voltage2"},
+		{"pvInputVoltage1", "pv_input_voltage1"},
+		{"batteryDischgCurrent", "battery_dischg_current"},
+		{"ACchargeOn", "ac_charge_on"},
+		{"ACchargeOn2", "ac_charge_on2"},
+		{"SCCchargeOn", "scc_charge_on"},
+		{"overLoad", "over_load"},
+		{"dataID", "data_id"},
+		{"timestr", "timestr"},
+	}
+
+	for _, tt := range tests {
+		if got := portalNameToSnakeCase(tt.name); got != tt.want {
+			t.Errorf("portalNameToSnakeCase(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
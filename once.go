@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"os"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// OutputStdout writes the metrics of the one-shot mode to standard output
+	OutputStdout = "stdout"
+
+	// OutputTextfile writes the metrics of the one-shot mode to a file for the node_exporter textfile collector
+	OutputTextfile = "textfile"
+)
+
+// Polls all devices once and writes the metrics to the configured output.
+// Returns the exit code of the process.
+func runOnce(e *exporter) int {
+	pollErr := e.calculateMetrics()
+	if pollErr != nil {
+		log.Errorln(pollErr)
+	}
+
+	e.closePublishers()
+
+	var err error
+
+	switch *output {
+	case OutputTextfile:
+		// Written to a temporary file and renamed, so the collector never reads a partial file
+		err = prometheus.WriteToTextfile(*textfilePath, e.Reg)
+	case OutputStdout:
+		err = writeMetrics(e.Reg)
+	}
+
+	if err != nil {
+		log.Errorln("Error writing metrics:", err)
+		return 1
+	}
+
+	if pollErr != nil {
+		return 1
+	}
+
+	return 0
+}
+
+// Writes the metrics of the gatherer to standard output in the text exposition format.
+func writeMetrics(g prometheus.Gatherer) error {
+	mfs, err := g.Gather()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+
+	for _, mf := range mfs {
+		if _, err := expfmt.MetricFamilyToText(os.Stdout, mf); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/resource"
+)
+
+const (
+	// OTLPProtocolGRPC exports OTLP over gRPC
+	OTLPProtocolGRPC = "grpc"
+
+	// OTLPProtocolHTTP exports OTLP as protobuf over HTTP
+	OTLPProtocolHTTP = "http/protobuf"
+
+	// Name of the instrumentation scope
+	otlpScope = "github.com/marevers/power-datacenter-exporter"
+)
+
+// Returns the headers of the otlp.headers flag.
+func otlpHeaders() (map[string]string, error) {
+	headers := map[string]string{}
+
+	if *otlpHeadersFlag == "" {
+		return headers, nil
+	}
+
+	for _, h := range strings.Split(*otlpHeadersFlag, ",") {
+		name, value, ok := strings.Cut(h, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid OTLP header %q", h)
+		}
+
+		headers[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+
+	return headers, nil
+}
+
+// Returns the resource of the exporter with the given additional attributes.
+func otlpResource(attrs ...attribute.KeyValue) *resource.Resource {
+	return resource.NewSchemaless(append([]attribute.KeyValue{attribute.String("service.name", *otlpServiceName)}, attrs...)...)
+}
+
+// Returns true if the endpoint is a URL instead of host and port.
+func otlpEndpointIsURL(endpoint string) bool {
+	return strings.Contains(endpoint, "://")
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/marevers/power-datacenter-exporter/pkg/pdc"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// otlpUnits are the units of the standard metric name suffixes, longest first
+var otlpUnits = []struct {
+	Suffix string
+	Unit   string
+}{
+	{"_volt_amperes_reactive", "var"},
+	{"_volt_amperes", "VA"},
+	{"_amperes", "A"},
+	{"_volts", "V"},
+	{"_hertz", "Hz"},
+	{"_watts", "W"},
+	{"_ratio", "1"},
+}
+
+// Returns the OTLP metric name and unit of a gauge in the standard naming scheme,
+// e.g. pdc.battery_voltage in V for battery_voltage_volts.
+func otlpMetricName(name string) (string, string) {
+	for _, u := range otlpUnits {
+		if strings.HasSuffix(name, u.Suffix) {
+			return Namespace + "." + strings.TrimSuffix(name, u.Suffix), u.Unit
+		}
+	}
+
+	return Namespace + "." + name, "1"
+}
+
+// energyDef describes an energy sum that is integrated from a power reading
+type energyDef struct {
+	Name        string
+	Description string
+	// Power returns the power in watts
+	Power func(wi *pdc.WorkInfo) float64
+}
+
+var energyDefs = []energyDef{
+	{
+		Name: "pv_input_energy", Description: "PV input energy since the exporter started, integrated from the total PV input power",
+		Power: func(wi *pdc.WorkInfo) float64 { return wi.TotalPvInputPower },
+	},
+	{
+		Name: "ac_output_energy", Description: "AC output active energy since the exporter started, integrated from the total AC output active power",
+		Power: func(wi *pdc.WorkInfo) float64 { return wi.TotalAcOutputActivePower },
+	},
+	{
+		Name: "battery_charge_energy", Description: "Battery charge energy since the exporter started, integrated from the battery power",
+		Power: func(wi *pdc.WorkInfo) float64 { return math.Max(batteryPower(wi), 0) },
+	},
+	{
+		Name: "battery_discharge_energy", Description: "Battery discharge energy since the exporter started, integrated from the battery power",
+		Power: func(wi *pdc.WorkInfo) float64 { return math.Max(-batteryPower(wi), 0) },
+	},
+}
+
+// energy are the energy sums of a device in joules by energy definition
+type energy struct {
+	Sampled time.Time
+	Power   []float64
+	Joules  []float64
+}
+
+// Integrates the energy sums with the power readings of a new sample. The power
+// is assumed to change linearly between samples, gaps longer than maxSampleGap are skipped.
+func (en *energy) update(wi *pdc.WorkInfo, t time.Time) {
+	if en.Joules == nil {
+		en.Joules = make([]float64, len(energyDefs))
+	}
+
+	power := make([]float64, len(energyDefs))
+
+	for i, def := range energyDefs {
+		power[i] = def.Power(wi)
+	}
+
+	if gap := t.Sub(en.Sampled); en.Power != nil && gap > 0 && gap <= maxSampleGap {
+		for i := range energyDefs {
+			en.Joules[i] += (en.Power[i] + power[i]) / 2 * gap.Seconds()
+		}
+	}
+
+	if t.After(en.Sampled) {
+		en.Sampled = t
+		en.Power = power
+	}
+}
+
+// sharedMetricExporter is shared by the meter providers of all devices and only shut down once
+type sharedMetricExporter struct {
+	sdkmetric.Exporter
+}
+
+func (sharedMetricExporter) Shutdown(context.Context) error {
+	return nil
+}
+
+// otlpMetricsPublisher exports the metrics of every device with OTLP. Each device has
+// its own meter provider, so the serial number and model are resource attributes.
+type otlpMetricsPublisher struct {
+	Exporter *exporter
+	Metrics  sdkmetric.Exporter
+
+	Providers map[string]*sdkmetric.MeterProvider
+	Energy    map[string]*energy
+	mu        sync.Mutex
+}
+
+// Returns a publisher exporting to the collector configured by the otlp flags.
+func newOTLPMetricsPublisher(e *exporter) (*otlpMetricsPublisher, error) {
+	headers, err := otlpHeaders()
+	if err != nil {
+		return nil, err
+	}
+
+	var exp sdkmetric.Exporter
+
+	switch *otlpProtocol {
+	case OTLPProtocolGRPC:
+		opts := []otlpmetricgrpc.Option{otlpmetricgrpc.WithHeaders(headers)}
+
+		switch {
+		case otlpEndpointIsURL(*otlpEndpoint):
+			opts = append(opts, otlpmetricgrpc.WithEndpointURL(*otlpEndpoint))
+		case *otlpEndpoint != "":
+			opts = append(opts, otlpmetricgrpc.WithEndpoint(*otlpEndpoint))
+		}
+
+		if *otlpInsecure {
+			opts = append(opts, otlpmetricgrpc.WithInsecure())
+		}
+
+		exp, err = otlpmetricgrpc.New(context.Background(), opts...)
+	case OTLPProtocolHTTP:
+		opts := []otlpmetrichttp.Option{otlpmetrichttp.WithHeaders(headers)}
+
+		switch {
+		case otlpEndpointIsURL(*otlpEndpoint):
+			opts = append(opts, otlpmetrichttp.WithEndpointURL(*otlpEndpoint))
+		case *otlpEndpoint != "":
+			opts = append(opts, otlpmetrichttp.WithEndpoint(*otlpEndpoint))
+		}
+
+		if *otlpInsecure {
+			opts = append(opts, otlpmetrichttp.WithInsecure())
+		}
+
+		exp, err = otlpmetrichttp.New(context.Background(), opts...)
+	default:
+		return nil, fmt.Errorf("invalid OTLP protocol: %s", *otlpProtocol)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &otlpMetricsPublisher{
+		Exporter:  e,
+		Metrics:   exp,
+		Providers: map[string]*sdkmetric.MeterProvider{},
+		Energy:    map[string]*energy{},
+	}, nil
+}
+
+func (p *otlpMetricsPublisher) publish(d *device) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	en, ok := p.Energy[d.SerialNumber]
+	if !ok {
+		en = &energy{}
+		p.Energy[d.SerialNumber] = en
+	}
+
+	en.update(&d.WorkInfo, d.sampleTime())
+
+	if _, ok := p.Providers[d.SerialNumber]; ok {
+		return
+	}
+
+	mp, err := p.newMeterProvider(d)
+	if err != nil {
+		log.Warnln("Error creating OTLP meter provider for", d.SerialNumber+":", err)
+		return
+	}
+
+	p.Providers[d.SerialNumber] = mp
+}
+
+// Returns a meter provider with the instruments of the device.
+func (p *otlpMetricsPublisher) newMeterProvider(d *device) (*sdkmetric.MeterProvider, error) {
+	attrs := []attribute.KeyValue{
+		attribute.String("device.serial", d.SerialNumber),
+		attribute.String("device.model", d.machineType()),
+	}
+
+	if d.Name != "" {
+		attrs = append(attrs, attribute.String("device.name", d.Name))
+	}
+
+	for i, name := range extraLabels {
+		attrs = append(attrs, attribute.String(name, d.LabelValues[i+1]))
+	}
+
+	mp := sdkmetric.NewMeterProvider(
+		sdkmetric.WithResource(otlpResource(attrs...)),
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(
+			sharedMetricExporter{p.Metrics},
+			sdkmetric.WithInterval(time.Duration(*otlpInterval)*time.Second),
+		)),
+	)
+
+	meter := mp.Meter(otlpScope)
+
+	var instruments []metric.Observable
+
+	// Gauges, numbered definitions share an instrument
+
+	gauges := map[string]metric.Float64ObservableGauge{}
+
+	for _, def := range gaugeDefs {
+		if def.Group == GroupPowerFactor && !*powerFactorMetrics {
+			continue
+		}
+
+		if _, ok := gauges[def.Name]; ok {
+			continue
+		}
+
+		name, unit := otlpMetricName(def.Name)
+
+		g, err := meter.Float64ObservableGauge(name, metric.WithUnit(unit), metric.WithDescription(def.Help))
+		if err != nil {
+			return nil, err
+		}
+
+		gauges[def.Name] = g
+		instruments = append(instruments, g)
+	}
+
+	// Named statuses as state sets
+
+	enums := make([]metric.Int64ObservableGauge, len(enumKinds))
+
+	for i, k := range enumKinds {
+		g, err := meter.Int64ObservableGauge(Namespace+"."+k.Name, metric.WithUnit("1"),
+			metric.WithDescription("1 for the current "+k.Description+", 0 for all other known values"))
+		if err != nil {
+			return nil, err
+		}
+
+		enums[i] = g
+		instruments = append(instruments, g)
+	}
+
+	// Energy sums
+
+	sums := make([]metric.Float64ObservableCounter, len(energyDefs))
+
+	for i, def := range energyDefs {
+		c, err := meter.Float64ObservableCounter(Namespace+"."+def.Name, metric.WithUnit("J"), metric.WithDescription(def.Description))
+		if err != nil {
+			return nil, err
+		}
+
+		sums[i] = c
+		instruments = append(instruments, c)
+	}
+
+	serial := d.SerialNumber
+
+	_, err := meter.RegisterCallback(func(ctx context.Context, o metric.Observer) error {
+		e := p.Exporter
+
+		d := e.device(serial)
+		if d == nil {
+			// The device is no longer attached to the account
+			return nil
+		}
+
+		e.mu.RLock()
+		wi := d.WorkInfo
+		e.mu.RUnlock()
+
+		for _, def := range gaugeDefs {
+			g, ok := gauges[def.Name]
+			if !ok {
+				continue
+			}
+
+			v := def.Value(&wi)
+			if math.IsNaN(v) {
+				continue
+			}
+
+			if def.Scale != 0 {
+				v *= def.Scale
+			}
+
+			var opts []metric.ObserveOption
+
+			if def.Dimension != "" {
+				opts = append(opts, metric.WithAttributes(attribute.String(def.Dimension, def.Index)))
+			}
+
+			o.ObserveFloat64(g, v, opts...)
+		}
+
+		for i, k := range enumKinds {
+			current := e.Config.normalize(k, k.Value(&wi))
+
+			for _, v := range e.Config.knownValues(k) {
+				var state int64
+				if v == current {
+					state = 1
+				}
+
+				o.ObserveInt64(enums[i], state, metric.WithAttributes(attribute.String(k.Label, v)))
+			}
+		}
+
+		p.mu.Lock()
+		joules := slices.Clone(p.Energy[serial].Joules)
+		p.mu.Unlock()
+
+		for i, c := range sums {
+			o.ObserveFloat64(c, joules[i])
+		}
+
+		return nil
+	}, instruments...)
+	if err != nil {
+		return nil, err
+	}
+
+	return mp, nil
+}
+
+// Shuts down the meter provider of a device that is no longer polled,
+// so its metrics are no longer exported.
+func (p *otlpMetricsPublisher) remove(serial string) {
+	p.mu.Lock()
+	mp, ok := p.Providers[serial]
+	delete(p.Providers, serial)
+	p.mu.Unlock()
+
+	if ok {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		if err := mp.Shutdown(ctx); err != nil {
+			log.Warnln("Error shutting down OTLP meter provider for", serial+":", err)
+		}
+	}
+
+	// The callback of the provider reads the energy sums until it is shut down
+	p.mu.Lock()
+	delete(p.Energy, serial)
+	p.mu.Unlock()
+}
+
+func (p *otlpMetricsPublisher) close() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// The callbacks lock the publisher when the providers export their metrics a last time
+	p.mu.Lock()
+	providers := maps.Clone(p.Providers)
+	p.mu.Unlock()
+
+	for serial, mp := range providers {
+		if err := mp.Shutdown(ctx); err != nil {
+			log.Warnln("Error shutting down OTLP meter provider for", serial+":", err)
+		}
+	}
+
+	if err := p.Metrics.Shutdown(ctx); err != nil {
+		log.Warnln("Error shutting down OTLP metrics exporter:", err)
+	}
+}
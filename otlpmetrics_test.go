@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"testing"
+
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+// testMetricExporter discards the exports of the meter providers
+type testMetricExporter struct{}
+
+func (*testMetricExporter) Temporality(k sdkmetric.InstrumentKind) metricdata.Temporality {
+	return sdkmetric.DefaultTemporalitySelector(k)
+}
+
+func (*testMetricExporter) Aggregation(k sdkmetric.InstrumentKind) sdkmetric.Aggregation {
+	return sdkmetric.DefaultAggregationSelector(k)
+}
+
+func (*testMetricExporter) Export(context.Context, *metricdata.ResourceMetrics) error { return nil }
+
+func (*testMetricExporter) ForceFlush(context.Context) error { return nil }
+
+func (*testMetricExporter) Shutdown(context.Context) error { return nil }
+
+func TestOTLPMetricsRemove(t *testing.T) {
+	tests := []struct {
+		name      string
+		remove    []string
+		remaining []string
+	}{
+		{"none", nil, []string{"1", "2"}},
+		{"one", []string{"1"}, []string{"2"}},
+		{"all", []string{"2", "1"}, nil},
+		{"unknown", []string{"3"}, []string{"1", "2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, otlpInterval, 3600)
+
+			e := &exporter{Config: &config{}}
+
+			for _, serial := range []string{"1", "2"} {
+				d := testDevice()
+				d.SerialNumber = serial
+				d.LabelValues = []string{serial}
+
+				e.Devices = append(e.Devices, d)
+			}
+
+			p := &otlpMetricsPublisher{
+				Exporter:  e,
+				Metrics:   &testMetricExporter{},
+				Providers: map[string]*sdkmetric.MeterProvider{},
+				Energy:    map[string]*energy{},
+			}
+
+			for _, d := range e.Devices {
+				p.publish(d)
+			}
+
+			providers := maps.Clone(p.Providers)
+
+			// Discovery removes the devices before the publishers
+			e.Devices = slices.DeleteFunc(e.Devices, func(d *device) bool { return slices.Contains(tt.remove, d.SerialNumber) })
+
+			for _, serial := range tt.remove {
+				p.remove(serial)
+			}
+
+			if got := slices.Sorted(maps.Keys(p.Providers)); !slices.Equal(got, tt.remaining) {
+				t.Errorf("providers = %v, want %v", got, tt.remaining)
+			}
+
+			if got := slices.Sorted(maps.Keys(p.Energy)); !slices.Equal(got, tt.remaining) {
+				t.Errorf("energy sums = %v, want %v", got, tt.remaining)
+			}
+
+			// Shutting down a provider again fails
+			for serial, mp := range providers {
+				err := mp.Shutdown(context.Background())
+
+				if removed := slices.Contains(tt.remove, serial); removed != (err != nil) {
+					t.Errorf("provider of %s shut down = %v, want %v", serial, err != nil, removed)
+				}
+			}
+		})
+	}
+}
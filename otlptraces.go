@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Returns a tracer provider exporting spans to the collector configured by the otlp flags.
+func newOTLPTracerProvider() (*sdktrace.TracerProvider, error) {
+	headers, err := otlpHeaders()
+	if err != nil {
+		return nil, err
+	}
+
+	var client otlptrace.Client
+
+	switch *otlpProtocol {
+	case OTLPProtocolGRPC:
+		opts := []otlptracegrpc.Option{otlptracegrpc.WithHeaders(headers)}
+
+		switch {
+		case otlpEndpointIsURL(*otlpEndpoint):
+			opts = append(opts, otlptracegrpc.WithEndpointURL(*otlpEndpoint))
+		case *otlpEndpoint != "":
+			opts = append(opts, otlptracegrpc.WithEndpoint(*otlpEndpoint))
+		}
+
+		if *otlpInsecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+
+		client = otlptracegrpc.NewClient(opts...)
+	case OTLPProtocolHTTP:
+		opts := []otlptracehttp.Option{otlptracehttp.WithHeaders(headers)}
+
+		switch {
+		case otlpEndpointIsURL(*otlpEndpoint):
+			opts = append(opts, otlptracehttp.WithEndpointURL(*otlpEndpoint))
+		case *otlpEndpoint != "":
+			opts = append(opts, otlptracehttp.WithEndpoint(*otlpEndpoint))
+		}
+
+		if *otlpInsecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+
+		client = otlptracehttp.NewClient(opts...)
+	default:
+		return nil, fmt.Errorf("invalid OTLP protocol: %s", *otlpProtocol)
+	}
+
+	exp, err := otlptrace.New(context.Background(), client)
+	if err != nil {
+		return nil, err
+	}
+
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithResource(otlpResource()),
+		sdktrace.WithBatcher(exp),
+	), nil
+}
+
+// Exports the remaining spans and stops the tracer provider.
+func shutdownTracerProvider(tp *sdktrace.TracerProvider) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := tp.Shutdown(ctx); err != nil {
+		log.Warnln("Error shutting down OTLP tracer provider:", err)
+	}
+}
+
+// traceLogHook adds the trace and span ID to log entries with a traced context,
+// e.g. log.WithContext(ctx).Infoln(...).
+type traceLogHook struct{}
+
+func (traceLogHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (traceLogHook) Fire(entry *log.Entry) error {
+	if entry.Context == nil {
+		return nil
+	}
+
+	sc := trace.SpanContextFromContext(entry.Context)
+	if !sc.IsValid() {
+		return nil
+	}
+
+	entry.Data["trace_id"] = sc.TraceID().String()
+	entry.Data["span_id"] = sc.SpanID().String()
+
+	return nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// outage tracks the grid outages of a single utility line, or the overloads of a device
+type outage struct {
+	// Count is the number of outages that started
+	Count float64 `json:"count"`
+	// Active is true during an outage
+	Active bool `json:"active"`
+	// Start and End are the start and end of the last outage, End is zero during an outage
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	// Downtime is the duration of all finished outages in seconds
+	Downtime float64 `json:"downtime"`
+}
+
+// Updates the outage with the line loss status sampled at the given time.
+// Returns true if an outage started or ended.
+func (o *outage) update(lost bool, t time.Time) bool {
+	switch {
+	case lost && !o.Active:
+		o.Count++
+		o.Active = true
+		o.Start = t
+		o.End = time.Time{}
+	case !lost && o.Active:
+		o.Active = false
+		o.End = t
+
+		if d := t.Sub(o.Start).Seconds(); d > 0 {
+			o.Downtime += d
+		}
+	default:
+		return false
+	}
+
+	return true
+}
+
+// Returns the duration of the current outage in seconds, 0 if there is none.
+func (o *outage) duration(now time.Time) float64 {
+	if !o.Active {
+		return 0
+	}
+
+	return max(now.Sub(o.Start).Seconds(), 0)
+}
+
+// Updates the outages from the latest work info of the device sampled at the given time.
+// Returns an event of the line_loss or line_loss2 kind for every outage that started or ended.
+func (ds *deviceState) trackOutages(ctx context.Context, d *device, t time.Time) []event {
+	lines := []struct {
+		Line string
+		Kind string
+		Lost bool
+	}{
+		{"1", "line_loss", d.WorkInfo.LineLoss1},
+		{"2", "line_loss2", d.WorkInfo.LineLoss2},
+	}
+
+	if ds.Outages == nil {
+		ds.Outages = map[string]*outage{}
+	}
+
+	var events []event
+
+	for _, l := range lines {
+		line, lost := l.Line, l.Lost
+
+		o, ok := ds.Outages[line]
+		if !ok {
+			o = &outage{}
+			ds.Outages[line] = o
+		}
+
+		if o.update(lost, t) {
+			events = append(events, event{
+				Time:         t,
+				SerialNumber: d.SerialNumber,
+				Kind:         l.Kind,
+				From:         formatFieldValue(!lost),
+				To:           formatFieldValue(lost),
+			})
+
+			if lost {
+				log.WithContext(ctx).Warnln("Grid outage on line", line, "of", d.SerialNumber, "started at", t)
+			} else {
+				log.WithContext(ctx).Infoln("Grid outage on line", line, "of", d.SerialNumber, "ended at", t)
+			}
+		}
+	}
+
+	return events
+}
+
+// Updates the overload from the latest work info of the device sampled at the given time.
+// Returns an event of the overload kind if an overload started or ended.
+func (ds *deviceState) trackOverload(ctx context.Context, d *device, t time.Time) []event {
+	if ds.Overload == nil {
+		ds.Overload = &outage{}
+	}
+
+	overload := d.WorkInfo.OverLoad
+
+	if !ds.Overload.update(overload, t) {
+		return nil
+	}
+
+	if overload {
+		log.WithContext(ctx).Warnln("Overload of", d.SerialNumber, "started at", t)
+	} else {
+		log.WithContext(ctx).Infoln("Overload of", d.SerialNumber, "ended at", t)
+	}
+
+	return []event{{
+		Time:         t,
+		SerialNumber: d.SerialNumber,
+		Kind:         "overload",
+		From:         formatFieldValue(!overload),
+		To:           formatFieldValue(overload),
+	}}
+}
+
+// outageCollector exposes the tracked grid outages of all devices
+type outageCollector struct {
+	e *exporter
+
+	outages   *prometheus.Desc
+	duration  *prometheus.Desc
+	lastStart *prometheus.Desc
+	lastEnd   *prometheus.Desc
+	downtime  *prometheus.Desc
+}
+
+func newOutageCollector(e *exporter, labels []string) *outageCollector {
+	l := append(slices.Clone(labels), LabelLine)
+
+	return &outageCollector{
+		e: e,
+		outages: prometheus.NewDesc(
+			prometheus.BuildFQName(Namespace, "", "grid_outages_total"),
+			"Number of grid outages that started", l, nil,
+		),
+		duration: prometheus.NewDesc(
+			prometheus.BuildFQName(Namespace, "", "grid_outage_duration_seconds"),
+			"Duration of the current grid outage in seconds, 0 if the line is online", l, nil,
+		),
+		lastStart: prometheus.NewDesc(
+			prometheus.BuildFQName(Namespace, "", "grid_last_outage_start_timestamp_seconds"),
+			"Start of the last grid outage as Unix timestamp", l, nil,
+		),
+		lastEnd: prometheus.NewDesc(
+			prometheus.BuildFQName(Namespace, "", "grid_last_outage_end_timestamp_seconds"),
+			"End of the last grid outage as Unix timestamp, not set during an outage", l, nil,
+		),
+		downtime: prometheus.NewDesc(
+			prometheus.BuildFQName(Namespace, "", "grid_downtime_seconds_total"),
+			"Cumulative duration of grid outages in seconds", l, nil,
+		),
+	}
+}
+
+func (c *outageCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.outages
+	ch <- c.duration
+	ch <- c.lastStart
+	ch <- c.lastEnd
+	ch <- c.downtime
+}
+
+func (c *outageCollector) Collect(ch chan<- prometheus.Metric) {
+	now := time.Now()
+
+	c.e.mu.RLock()
+	defer c.e.mu.RUnlock()
+
+	for _, d := range c.e.Devices {
+		ds, ok := c.e.State.Devices[d.SerialNumber]
+		if !ok {
+			continue
+		}
+
+		for line, o := range ds.Outages {
+			lv := append(slices.Clone(d.LabelValues), line)
+
+			ch <- prometheus.MustNewConstMetric(c.outages, prometheus.CounterValue, o.Count, lv...)
+			ch <- prometheus.MustNewConstMetric(c.duration, prometheus.GaugeValue, o.duration(now), lv...)
+			ch <- prometheus.MustNewConstMetric(c.downtime, prometheus.CounterValue, o.Downtime+o.duration(now), lv...)
+
+			if !o.Start.IsZero() {
+				ch <- prometheus.MustNewConstMetric(c.lastStart, prometheus.GaugeValue, float64(o.Start.Unix()), lv...)
+			}
+
+			if !o.End.IsZero() {
+				ch <- prometheus.MustNewConstMetric(c.lastEnd, prometheus.GaugeValue, float64(o.End.Unix()), lv...)
+			}
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOutageUpdate(t *testing.T) {
+	t0 := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	type step struct {
+		lost    bool
+		t       time.Time
+		changed bool
+	}
+
+	tests := []struct {
+		name  string
+		steps []step
+		want  outage
+	}{
+		{
+			name:  "online",
+			steps: []step{{false, t0, false}, {false, t0.Add(time.Minute), false}},
+			want:  outage{},
+		},
+		{
+			name:  "outage starts",
+			steps: []step{{false, t0, false}, {true, t0.Add(time.Minute), true}, {true, t0.Add(2 * time.Minute), false}},
+			want:  outage{Count: 1, Active: true, Start: t0.Add(time.Minute)},
+		},
+		{
+			name:  "outage ends",
+			steps: []step{{true, t0, true}, {false, t0.Add(5 * time.Minute), true}},
+			want:  outage{Count: 1, Start: t0, End: t0.Add(5 * time.Minute), Downtime: 300},
+		},
+		{
+			name: "downtime accumulates",
+			steps: []step{
+				{true, t0, true}, {false, t0.Add(time.Minute), true},
+				{true, t0.Add(time.Hour), true}, {false, t0.Add(time.Hour + 2*time.Minute), true},
+			},
+			want: outage{Count: 2, Start: t0.Add(time.Hour), End: t0.Add(time.Hour + 2*time.Minute), Downtime: 180},
+		},
+		{
+			name:  "new outage clears the end",
+			steps: []step{{true, t0, true}, {false, t0.Add(time.Minute), true}, {true, t0.Add(time.Hour), true}},
+			want:  outage{Count: 2, Active: true, Start: t0.Add(time.Hour), Downtime: 60},
+		},
+		{
+			name:  "end before start adds no downtime",
+			steps: []step{{true, t0, true}, {false, t0.Add(-time.Minute), true}},
+			want:  outage{Count: 1, Start: t0, End: t0.Add(-time.Minute)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var o outage
+
+			for i, s := range tt.steps {
+				if got := o.update(s.lost, s.t); got != s.changed {
+					t.Errorf("step %d: update() = %v, want %v", i, got, s.changed)
+				}
+			}
+
+			if o != tt.want {
+				t.Errorf("outage = %+v, want %+v", o, tt.want)
+			}
+		})
+	}
+}
+
+func TestOutageDuration(t *testing.T) {
+	t0 := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		o    outage
+		now  time.Time
+		want float64
+	}{
+		{"online", outage{Start: t0, End: t0.Add(time.Minute)}, t0.Add(time.Hour), 0},
+		{"active", outage{Active: true, Start: t0}, t0.Add(90 * time.Second), 90},
+		{"clock behind the start", outage{Active: true, Start: t0}, t0.Add(-time.Minute), 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.o.duration(tt.now); got != tt.want {
+				t.Errorf("duration() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package pdc
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"net/http"
 	"net/url"
@@ -20,12 +21,12 @@ func newHttpClient(to int) *http.Client {
 	}
 }
 
-func postRequestForm(baseUrl, path, jSessionId string, urlValues url.Values) (*http.Response, error) {
+func postRequestForm(ctx context.Context, baseUrl, path, jSessionId string, urlValues url.Values) (*http.Response, error) {
 	method := "POST"
 
 	payload := strings.NewReader(urlValues.Encode())
 
-	req, err := http.NewRequest(method, baseUrl+path, payload)
+	req, err := http.NewRequestWithContext(ctx, method, baseUrl+path, payload)
 	if err != nil {
 		return nil, err
 	}
@@ -41,7 +42,7 @@ func postRequestForm(baseUrl, path, jSessionId string, urlValues url.Values) (*h
 
 	client := newHttpClient(0)
 
-	res, err := client.Do(req)
+	res, err := doRequest(req, client)
 	if err != nil {
 		return nil, err
 	} else if res.StatusCode != http.StatusOK {
@@ -51,10 +52,10 @@ func postRequestForm(baseUrl, path, jSessionId string, urlValues url.Values) (*h
 	return res, nil
 }
 
-func postRequest(baseUrl, path, jSessionId string) (*http.Response, error) {
+func postRequest(ctx context.Context, baseUrl, path, jSessionId string) (*http.Response, error) {
 	method := "POST"
 
-	req, err := http.NewRequest(method, baseUrl+path, nil)
+	req, err := http.NewRequestWithContext(ctx, method, baseUrl+path, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -70,7 +71,7 @@ func postRequest(baseUrl, path, jSessionId string) (*http.Response, error) {
 
 	client := newHttpClient(0)
 
-	res, err := client.Do(req)
+	res, err := doRequest(req, client)
 	if err != nil {
 		return nil, err
 	} else if res.StatusCode != http.StatusOK {
@@ -80,12 +81,12 @@ func postRequest(baseUrl, path, jSessionId string) (*http.Response, error) {
 	return res, nil
 }
 
-func postRequestJsonString(baseUrl, path, jSessionId, jsonString string) (*http.Response, error) {
+func postRequestJsonString(ctx context.Context, baseUrl, path, jSessionId, jsonString string) (*http.Response, error) {
 	method := "POST"
 
 	payload := []byte(jsonString)
 
-	req, err := http.NewRequest(method, baseUrl+path, bytes.NewBuffer(payload))
+	req, err := http.NewRequestWithContext(ctx, method, baseUrl+path, bytes.NewBuffer(payload))
 	if err != nil {
 		return nil, err
 	}
@@ -101,7 +102,7 @@ func postRequestJsonString(baseUrl, path, jSessionId, jsonString string) (*http.
 
 	client := newHttpClient(0)
 
-	res, err := client.Do(req)
+	res, err := doRequest(req, client)
 	if err != nil {
 		return nil, err
 	} else if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNoContent {
@@ -1,16 +1,23 @@
 package pdc
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/url"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
 )
 
 const (
-	PathLogin    = "/cmc/login_system.html"
-	PathWorkInfo = "/cmc/getWorkInfo.html"
-	Protocol     = "41"
+	PathLogin      = "/cmc/login_system.html"
+	PathWorkInfo   = "/cmc/getWorkInfo.html"
+	PathDeviceList = "/cmc/getDeviceList.html"
+
+	// Protocol is the protocol ID used when none is configured
+	Protocol = "41"
 )
 
 type Session struct {
@@ -21,6 +28,23 @@ type Session struct {
 	WorkInfo     WorkInfo
 }
 
+// Device is an inverter attached to the account of a session.
+type Device struct {
+	SerialNumber string
+	Name         string
+	MachineType  string
+	Protocol     string
+	Online       bool
+}
+
+type deviceListEntry struct {
+	SerialNo    string      `json:"serialNo"`
+	DeviceName  string      `json:"deviceName"`
+	MachineType string      `json:"machineType"`
+	Protocol    json.Number `json:"protocol"`
+	Online      bool        `json:"online"`
+}
+
 type WorkInfo struct {
 	SerialNo                   string  `json:"serialNo"`
 	GridFrequency1             float64 `json:"gridFrequency"`
@@ -79,22 +103,55 @@ type WorkInfo struct {
 	} `json:"time"`
 }
 
+// Returns the time the work info was sampled on the device, or the zero time if it is unknown.
+// The time is reported as date fields in the timezone of the portal together with the offset
+// of that timezone in minutes behind UTC, falling back to the Unix time in milliseconds.
+func (w *WorkInfo) SampleTime() time.Time {
+	t := w.Time
+
+	if t.Year != 0 {
+		loc := time.FixedZone("", -t.TimezoneOffset*60)
+
+		return time.Date(t.Year+1900, time.Month(t.Month+1), t.Date, t.Hours, t.Minutes, t.Seconds, 0, loc).Local()
+	}
+
+	if t.Time != 0 {
+		return time.UnixMilli(t.Time)
+	}
+
+	return time.Time{}
+}
+
 // Returns a new session.
 func NewSession(baseUrl, serialNumber string) *Session {
 	return &Session{
 		BaseUrl:      baseUrl,
 		SerialNumber: serialNumber,
+		Protocol:     Protocol,
 	}
 }
 
 // Retrieves a JSESSIONID using the provided username and password
 // and stores it in the session.
 func (s *Session) Login(username, password string) error {
+	return s.LoginContext(context.Background(), username, password)
+}
+
+// LoginContext is like Login, but traces the login as part of the given context.
+func (s *Session) LoginContext(ctx context.Context, username, password string) (err error) {
+	ctx, span := tracer().Start(ctx, "Session.Login")
+	defer span.End()
+
+	// A session that already has a JSESSIONID is renewed
+	span.SetAttributes(attribute.Bool(AttributeRelogin, s.JSessionId != ""))
+
+	defer func() { recordError(span, err) }()
+
 	data := url.Values{}
 	data.Add("username", username)
 	data.Add("password", password)
 
-	res, err := postRequestForm(s.BaseUrl, PathLogin, "", data)
+	res, err := postRequestForm(ctx, s.BaseUrl, PathLogin, "", data)
 	if err != nil {
 		return err
 	}
@@ -111,26 +168,108 @@ func (s *Session) Login(username, password string) error {
 	return ErrLoginFailed
 }
 
-// Retrieves the current work info for the given session.
-func (s *Session) GetWorkInfo() error {
-	path := fmt.Sprintf("%v?serialNo=%v&protocol=%v", PathWorkInfo, s.SerialNumber, Protocol)
+// Retrieves the devices attached to the account of the session.
+func (s *Session) ListDevices() ([]Device, error) {
+	return s.ListDevicesContext(context.Background())
+}
 
-	res, err := postRequest(s.BaseUrl, path, s.JSessionId)
+// ListDevicesContext is like ListDevices, but traces the request as part of the given context.
+func (s *Session) ListDevicesContext(ctx context.Context) (_ []Device, err error) {
+	ctx, span := tracer().Start(ctx, "Session.ListDevices")
+	defer span.End()
+
+	defer func() { recordError(span, err) }()
+
+	res, err := postRequest(ctx, s.BaseUrl, PathDeviceList, s.JSessionId)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	defer res.Body.Close()
 
 	b, err := io.ReadAll(res.Body)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	err = json.Unmarshal(b, &s.WorkInfo)
+	var entries []deviceListEntry
+
+	err = json.Unmarshal(b, &entries)
+	if err != nil {
+		return nil, err
+	}
+
+	devices := make([]Device, 0, len(entries))
+
+	for _, e := range entries {
+		devices = append(devices, Device{
+			SerialNumber: e.SerialNo,
+			Name:         e.DeviceName,
+			MachineType:  e.MachineType,
+			Protocol:     e.Protocol.String(),
+			Online:       e.Online,
+		})
+	}
+
+	return devices, nil
+}
+
+// Retrieves the current work info for the given session.
+func (s *Session) GetWorkInfo() error {
+	d := Device{
+		SerialNumber: s.SerialNumber,
+		Protocol:     s.Protocol,
+	}
+
+	wi, err := s.GetDeviceWorkInfo(&d)
 	if err != nil {
 		return err
 	}
 
+	s.WorkInfo = wi
+
 	return nil
 }
+
+// Retrieves the current work info for the given device.
+func (s *Session) GetDeviceWorkInfo(d *Device) (WorkInfo, error) {
+	return s.GetDeviceWorkInfoContext(context.Background(), d)
+}
+
+// GetDeviceWorkInfoContext is like GetDeviceWorkInfo, but traces the requests as part of the given context.
+func (s *Session) GetDeviceWorkInfoContext(ctx context.Context, d *Device) (_ WorkInfo, err error) {
+	ctx, span := tracer().Start(ctx, "Session.GetWorkInfo")
+	defer span.End()
+
+	span.SetAttributes(attribute.String(AttributeSerialNumber, d.SerialNumber))
+
+	defer func() {
+		span.SetAttributes(attribute.String(AttributeProtocol, d.Protocol))
+		recordError(span, err)
+	}()
+
+	protocol := d.Protocol
+	if protocol == "" {
+		protocol = Protocol
+	}
+
+	return s.getWorkInfo(ctx, d.SerialNumber, protocol)
+}
+
+func (s *Session) getWorkInfo(ctx context.Context, serialNumber, protocol string) (WorkInfo, error) {
+	path := fmt.Sprintf("%v?serialNo=%v&protocol=%v", PathWorkInfo, serialNumber, protocol)
+
+	res, err := postRequest(ctx, s.BaseUrl, path, s.JSessionId)
+	if err != nil {
+		return WorkInfo{}, err
+	}
+
+	defer res.Body.Close()
+
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return WorkInfo{}, err
+	}
+
+	return decodeWorkInfo(b, protocol)
+}
@@ -0,0 +1,54 @@
+package pdc
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestSampleTime(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		want    time.Time
+	}{
+		{
+			name:    "date fields ahead of UTC",
+			payload: string(readFixture(t, "workinfo.json")),
+			want:    time.Date(2024, 6, 1, 12, 35, 7, 0, time.UTC),
+		},
+		{
+			name:    "date fields behind UTC",
+			payload: `{"time":{"year":124,"month":0,"date":31,"hours":20,"minutes":5,"seconds":0,"timezoneOffset":300}}`,
+			want:    time.Date(2024, 2, 1, 1, 5, 0, 0, time.UTC),
+		},
+		{
+			name:    "date fields take precedence over Unix time",
+			payload: `{"time":{"year":124,"month":5,"date":1,"hours":12,"minutes":0,"seconds":0,"timezoneOffset":0,"time":1}}`,
+			want:    time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC),
+		},
+		{
+			name:    "Unix time without date fields",
+			payload: `{"time":{"time":1717245307000}}`,
+			want:    time.Date(2024, 6, 1, 12, 35, 7, 0, time.UTC),
+		},
+		{
+			name:    "not reported",
+			payload: `{"serialNo":"92632105100000"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var wi WorkInfo
+
+			if err := json.Unmarshal([]byte(tt.payload), &wi); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := wi.SampleTime(); !got.Equal(tt.want) {
+				t.Errorf("SampleTime() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package pdc
+
+import (
+	"encoding/json"
+)
+
+// Field mappings per protocol. WorkInfo is modelled after the payload of
+// protocol 41, so every mapping translates payload keys of another protocol
+// to the keys used by protocol 41. Protocols without a mapping are decoded as is.
+var protocolFieldMappings = map[string]map[string]string{}
+
+// Decodes a work info payload using the field mapping of the given protocol.
+func decodeWorkInfo(b []byte, protocol string) (WorkInfo, error) {
+	var wi WorkInfo
+
+	if mapping := protocolFieldMappings[protocol]; len(mapping) > 0 {
+		raw := map[string]json.RawMessage{}
+
+		if err := json.Unmarshal(b, &raw); err != nil {
+			return wi, err
+		}
+
+		for from, to := range mapping {
+			if v, ok := raw[from]; ok {
+				delete(raw, from)
+				raw[to] = v
+			}
+		}
+
+		var err error
+
+		b, err = json.Marshal(raw)
+		if err != nil {
+			return wi, err
+		}
+	}
+
+	err := json.Unmarshal(b, &wi)
+
+	return wi, err
+}
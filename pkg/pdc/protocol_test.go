@@ -0,0 +1,80 @@
+package pdc
+
+import (
+	"os"
+	"testing"
+)
+
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+
+	b, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+func TestDecodeWorkInfo(t *testing.T) {
+	// Mapping of a protocol numbering the fields of the first line
+	protocolFieldMappings["test"] = map[string]string{"gridVoltage1": "gridVoltage", "lineLoss1": "lineLoss"}
+	t.Cleanup(func() { delete(protocolFieldMappings, "test") })
+
+	tests := []struct {
+		name     string
+		payload  string
+		protocol string
+		want     func(WorkInfo) bool
+		wantErr  bool
+	}{
+		{
+			name:     "default protocol",
+			payload:  string(readFixture(t, "workinfo.json")),
+			protocol: Protocol,
+			want: func(wi WorkInfo) bool {
+				return wi.SerialNo == "92632105100000" && wi.GridVoltage1 == 231.4 && wi.BatCapacity == 87 &&
+					wi.WorkMode == "Battery Mode" && wi.HasLoad1 && !wi.ACchargeOn1 && wi.DataID == 89619160
+			},
+		},
+		{
+			name:     "unmapped protocol",
+			payload:  `{"serialNo":"S1","gridVoltage1":230}`,
+			protocol: "99",
+			want:     func(wi WorkInfo) bool { return wi.SerialNo == "S1" && wi.GridVoltage1 == 0 },
+		},
+		{
+			name:     "mapped protocol",
+			payload:  `{"serialNo":"S1","gridVoltage1":230,"gridVoltage2":229,"lineLoss1":true}`,
+			protocol: "test",
+			want: func(wi WorkInfo) bool {
+				return wi.GridVoltage1 == 230 && wi.GridVoltage2 == 229 && wi.LineLoss1
+			},
+		},
+		{
+			name:     "invalid payload",
+			payload:  `<html>`,
+			protocol: Protocol,
+			wantErr:  true,
+		},
+		{
+			name:     "invalid payload of mapped protocol",
+			payload:  `<html>`,
+			protocol: "test",
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wi, err := decodeWorkInfo([]byte(tt.payload), tt.protocol)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decodeWorkInfo() error = %v, want error %v", err, tt.wantErr)
+			}
+
+			if !tt.wantErr && !tt.want(wi) {
+				t.Errorf("decodeWorkInfo() = %+v", wi)
+			}
+		})
+	}
+}
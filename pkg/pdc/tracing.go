@@ -0,0 +1,64 @@
+package pdc
+
+import (
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// Name of the instrumentation scope
+	tracerName = "github.com/marevers/power-datacenter-exporter/pkg/pdc"
+
+	// AttributeSerialNumber is the span attribute of the device serial number
+	AttributeSerialNumber = "pdc.serial_number"
+
+	// AttributeProtocol is the span attribute of the protocol ID
+	AttributeProtocol = "pdc.protocol"
+
+	// AttributeRelogin is the span attribute that is true if an existing session is renewed
+	AttributeRelogin = "pdc.relogin"
+)
+
+// Returns the tracer of the package. Spans are only recorded if a tracer provider is registered with otel.
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// Records the error on the span if it is not nil.
+func recordError(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
+
+// Sends the request in a client span carrying the method, path and response status code.
+func doRequest(req *http.Request, client *http.Client) (*http.Response, error) {
+	ctx, span := tracer().Start(req.Context(), req.Method+" "+req.URL.Path,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.request.method", req.Method),
+			attribute.String("server.address", req.URL.Hostname()),
+			attribute.String("url.path", req.URL.Path),
+		),
+	)
+	defer span.End()
+
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		recordError(span, err)
+		return nil, err
+	}
+
+	span.SetAttributes(attribute.Int("http.response.status_code", res.StatusCode))
+
+	if res.StatusCode >= 400 {
+		span.SetStatus(codes.Error, http.StatusText(res.StatusCode))
+	}
+
+	return res, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/marevers/power-datacenter-exporter/pkg/pdc"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// publisher is an output the work info of a device is pushed to whenever new data was retrieved
+type publisher interface {
+	// publish is called from the polling goroutine and should not block for long
+	publish(d *device)
+	// close flushes pending data and disconnects
+	close()
+}
+
+// deviceRemover is implemented by publishers that keep state per device
+type deviceRemover interface {
+	// remove releases the state of a device that is no longer polled
+	remove(serial string)
+}
+
+// Pushes the latest work info of the device to all publishers.
+func (e *exporter) publish(d *device) {
+	for _, p := range e.Publishers {
+		p.publish(d)
+	}
+}
+
+// Releases the state the publishers keep for the device with the given serial number.
+func (e *exporter) removeFromPublishers(serial string) {
+	for _, p := range e.Publishers {
+		if r, ok := p.(deviceRemover); ok {
+			r.remove(serial)
+		}
+	}
+}
+
+// Closes all publishers.
+func (e *exporter) closePublishers() {
+	for _, p := range e.Publishers {
+		p.close()
+	}
+}
+
+// field is a single reading of the work info
+type field struct {
+	// Name is the snake case of the name used by the portal, e.g. battery_voltage
+	Name  string
+	Value any
+}
+
+// Returns the float, bool and string readings of the work info in declaration order.
+func workInfoFields(wi *pdc.WorkInfo) []field {
+	var fields []field
+
+	v := reflect.ValueOf(wi).Elem()
+
+	for i := 0; i < v.NumField(); i++ {
+		name, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("json"), ",")
+
+		switch fv := v.Field(i); fv.Kind() {
+		case reflect.Float64, reflect.Bool, reflect.String:
+			fields = append(fields, field{Name: portalNameToSnakeCase(name), Value: fv.Interface()})
+		}
+	}
+
+	return fields
+}
+
+// Converts a portal name to snake case. Acronyms in portal names are
+// followed by a lowercase word, e.g. ACchargeOn becomes ac_charge_on.
+func portalNameToSnakeCase(s string) string {
+	r := []rune(s)
+
+	var b strings.Builder
+
+	for i, c := range r {
+		switch {
+		case i == 0:
+		case unicode.IsUpper(c) && !unicode.IsUpper(r[i-1]):
+			b.WriteByte('_')
+		case unicode.IsLower(c) && i > 1 && unicode.IsUpper(r[i-1]) && unicode.IsUpper(r[i-2]):
+			b.WriteByte('_')
+		}
+
+		b.WriteRune(unicode.ToLower(c))
+	}
+
+	return b.String()
+}
+
+// Formats a field value as plain text.
+func formatFieldValue(v any) string {
+	switch v := v.(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case string:
+		return v
+	default:
+		log.Warnf("Unsupported field value %T", v)
+		return ""
+	}
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Maximum delay between retries of failed remote writes
+	remoteWriteMaxBackoff = 5 * time.Minute
+)
+
+// labelPair is a label of a remote write time series
+type labelPair struct {
+	Name  string
+	Value string
+}
+
+// remoteWriteRequest is a snappy compressed remote write request
+type remoteWriteRequest struct {
+	Body    []byte
+	Samples int
+}
+
+// remoteWriter periodically gathers the metrics of the exporter and sends them
+// to a Prometheus remote write endpoint. Requests that could not be sent are
+// queued and retried with an increasing delay.
+type remoteWriter struct {
+	Client   *http.Client
+	Gatherer prometheus.Gatherer
+	// Labels are added to every time series, sorted by name
+	Labels []labelPair
+
+	Queue   []remoteWriteRequest
+	Backoff time.Duration
+	NextTry time.Time
+
+	// Stop is closed to stop the writer, which closes Stopped after a last push
+	Stop    chan struct{}
+	Stopped chan struct{}
+
+	SentSamples    prometheus.Counter
+	DroppedSamples prometheus.Counter
+	Failures       prometheus.Counter
+	QueueLength    prometheus.Gauge
+}
+
+// Returns a remote writer for the endpoint configured by the remote-write flags.
+func newRemoteWriter(e *exporter) (*remoteWriter, error) {
+	w := &remoteWriter{
+		Client:   &http.Client{Timeout: 30 * time.Second},
+		Gatherer: e.Reg,
+		Stop:     make(chan struct{}),
+		Stopped:  make(chan struct{}),
+	}
+
+	instance := *remoteWriteInstance
+	if instance == "" {
+		var err error
+
+		if instance, err = os.Hostname(); err != nil {
+			return nil, err
+		}
+	}
+
+	w.Labels = []labelPair{{"job", *remoteWriteJob}, {"instance", instance}}
+
+	if *remoteWriteExternalLabels != "" {
+		for _, l := range strings.Split(*remoteWriteExternalLabels, ",") {
+			name, value, ok := strings.Cut(l, "=")
+			if !ok || !labelNameRegexp.MatchString(name) {
+				return nil, fmt.Errorf("invalid external label %q", l)
+			}
+
+			w.Labels = slices.DeleteFunc(w.Labels, func(lp labelPair) bool { return lp.Name == name })
+			w.Labels = append(w.Labels, labelPair{name, value})
+		}
+	}
+
+	sortLabels(w.Labels)
+
+	w.SentSamples = promauto.With(e.Reg).NewCounter(prometheus.CounterOpts{
+		Name:      "remote_write_samples_sent_total",
+		Namespace: Namespace,
+		Help:      "Number of samples sent to the remote write endpoint",
+	})
+
+	w.DroppedSamples = promauto.With(e.Reg).NewCounter(prometheus.CounterOpts{
+		Name:      "remote_write_samples_dropped_total",
+		Namespace: Namespace,
+		Help:      "Number of samples dropped because the queue was full or the endpoint rejected them",
+	})
+
+	w.Failures = promauto.With(e.Reg).NewCounter(prometheus.CounterOpts{
+		Name:      "remote_write_failures_total",
+		Namespace: Namespace,
+		Help:      "Number of failed requests to the remote write endpoint",
+	})
+
+	w.QueueLength = promauto.With(e.Reg).NewGauge(prometheus.GaugeOpts{
+		Name:      "remote_write_queue_length",
+		Namespace: Namespace,
+		Help:      "Number of requests waiting to be sent to the remote write endpoint",
+	})
+
+	return w, nil
+}
+
+// Gathers and sends the metrics at the given interval, retrying failed requests in between,
+// until the writer is closed.
+func (w *remoteWriter) run(t time.Duration) {
+	defer close(w.Stopped)
+
+	next := time.Now()
+
+	tmr := time.NewTimer(0)
+	defer tmr.Stop()
+
+	for {
+		select {
+		case <-w.Stop:
+			w.flushLast()
+			return
+		case <-tmr.C:
+		}
+
+		if now := time.Now(); !now.Before(next) {
+			w.enqueue(now)
+			next = now.Add(t)
+		}
+
+		w.flush()
+
+		wait := time.Until(next)
+		if len(w.Queue) > 0 {
+			wait = min(wait, time.Until(w.NextTry))
+		}
+
+		tmr.Reset(wait)
+	}
+}
+
+// Pushes the latest metrics and tries to send the queued requests once more,
+// regardless of the retry delay. Requests that still could not be sent are dropped.
+func (w *remoteWriter) flushLast() {
+	w.enqueue(time.Now())
+
+	w.NextTry = time.Time{}
+	w.flush()
+
+	if len(w.Queue) == 0 {
+		return
+	}
+
+	var samples int
+
+	for _, r := range w.Queue {
+		samples += r.Samples
+	}
+
+	log.Warnf("Dropping %d queued remote write requests on shutdown", len(w.Queue))
+
+	w.DroppedSamples.Add(float64(samples))
+	w.Queue = nil
+	w.QueueLength.Set(0)
+}
+
+// Stops the writer and waits until the last push was sent.
+func (w *remoteWriter) close() {
+	close(w.Stop)
+	<-w.Stopped
+}
+
+// Gathers the metrics and adds them to the queue as a single request.
+func (w *remoteWriter) enqueue(now time.Time) {
+	mfs, err := w.Gatherer.Gather()
+	if err != nil {
+		// Gather returns all metrics it could collect together with the error
+		log.Warnln("Error gathering metrics for remote write:", err)
+	}
+
+	body, samples := encodeWriteRequest(mfs, w.Labels, now.UnixMilli())
+	if samples == 0 {
+		return
+	}
+
+	w.Queue = append(w.Queue, remoteWriteRequest{Body: snappy.Encode(nil, body), Samples: samples})
+
+	if n := len(w.Queue) - *remoteWriteQueueSize; n > 0 {
+		for _, r := range w.Queue[:n] {
+			w.DroppedSamples.Add(float64(r.Samples))
+		}
+
+		w.Queue = slices.Delete(w.Queue, 0, n)
+	}
+
+	w.QueueLength.Set(float64(len(w.Queue)))
+}
+
+// Sends the queued requests, oldest first. On failure the remaining requests
+// are kept and retried with an increasing delay.
+func (w *remoteWriter) flush() {
+	if time.Now().Before(w.NextTry) {
+		return
+	}
+
+	for len(w.Queue) > 0 {
+		r := w.Queue[0]
+
+		err := w.send(r.Body)
+
+		var perr *remoteWritePermanentError
+
+		switch {
+		case errors.As(err, &perr):
+			log.Warnf("Remote write endpoint rejected %d samples, dropping them: %v", r.Samples, err)
+			w.DroppedSamples.Add(float64(r.Samples))
+		case err != nil:
+			w.Backoff = min(max(w.Backoff*2, time.Second), remoteWriteMaxBackoff)
+			w.NextTry = time.Now().Add(w.Backoff)
+
+			log.Warnf("Error sending to remote write endpoint, retrying %d queued requests in %v: %v", len(w.Queue), w.Backoff, err)
+
+			return
+		default:
+			w.SentSamples.Add(float64(r.Samples))
+		}
+
+		w.Backoff = 0
+		w.Queue = w.Queue[1:]
+		w.QueueLength.Set(float64(len(w.Queue)))
+	}
+}
+
+// remoteWritePermanentError is a remote write error that does not succeed when retried
+type remoteWritePermanentError struct {
+	error
+}
+
+// Sends a compressed write request.
+func (w *remoteWriter) send(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, *remoteWriteURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "power-datacenter-exporter")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	switch {
+	case *remoteWriteBearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+*remoteWriteBearerToken)
+	case *remoteWriteUsername != "":
+		req.SetBasicAuth(*remoteWriteUsername, *remoteWritePassword)
+	}
+
+	if *remoteWriteTenant != "" {
+		req.Header.Set("X-Scope-OrgID", *remoteWriteTenant)
+	}
+
+	res, err := w.Client.Do(req)
+	if err != nil {
+		w.Failures.Inc()
+		return err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode/100 == 2 {
+		return nil
+	}
+
+	w.Failures.Inc()
+
+	b, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+	err = fmt.Errorf("HTTP %v %v: %s", res.StatusCode, http.StatusText(res.StatusCode), bytes.TrimSpace(b))
+
+	// Client errors other than rate limiting are returned again when retried
+	if res.StatusCode/100 == 4 && res.StatusCode != http.StatusTooManyRequests {
+		return &remoteWritePermanentError{err}
+	}
+
+	return err
+}
+
+// Sorts labels by name as required by remote write.
+func sortLabels(l []labelPair) {
+	slices.SortFunc(l, func(a, b labelPair) int { return strings.Compare(a.Name, b.Name) })
+}
+
+// Encodes the metric families as remote write request. Samples without timestamp
+// get the given timestamp in milliseconds. Returns the request and the number of samples.
+func encodeWriteRequest(mfs []*dto.MetricFamily, extra []labelPair, ts int64) ([]byte, int) {
+	var (
+		b       []byte
+		samples int
+	)
+
+	add := func(name string, m *dto.Metric, v float64, more ...labelPair) {
+		labels := []labelPair{{"__name__", name}}
+
+		for _, lp := range m.GetLabel() {
+			labels = append(labels, labelPair{lp.GetName(), lp.GetValue()})
+		}
+
+		labels = append(labels, more...)
+
+		for _, lp := range extra {
+			if !slices.ContainsFunc(labels, func(l labelPair) bool { return l.Name == lp.Name }) {
+				labels = append(labels, lp)
+			}
+		}
+
+		sortLabels(labels)
+
+		t := ts
+		if m.TimestampMs != nil {
+			t = m.GetTimestampMs()
+		}
+
+		b = appendTimeSeries(b, labels, v, t)
+		samples++
+	}
+
+	for _, mf := range mfs {
+		name := mf.GetName()
+
+		for _, m := range mf.GetMetric() {
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				add(name, m, m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add(name, m, m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				add(name, m, m.GetUntyped().GetValue())
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+
+				for _, q := range s.GetQuantile() {
+					add(name, m, q.GetValue(), labelPair{"quantile", formatFloat(q.GetQuantile())})
+				}
+
+				add(name+"_sum", m, s.GetSampleSum())
+				add(name+"_count", m, float64(s.GetSampleCount()))
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+
+				for _, bk := range h.GetBucket() {
+					add(name+"_bucket", m, float64(bk.GetCumulativeCount()), labelPair{"le", formatFloat(bk.GetUpperBound())})
+				}
+
+				add(name+"_bucket", m, float64(h.GetSampleCount()), labelPair{"le", "+Inf"})
+				add(name+"_sum", m, h.GetSampleSum())
+				add(name+"_count", m, float64(h.GetSampleCount()))
+			}
+		}
+	}
+
+	return b, samples
+}
+
+// Appends a time series with a single sample to a WriteRequest message.
+func appendTimeSeries(b []byte, labels []labelPair, v float64, ts int64) []byte {
+	var series []byte
+
+	for _, l := range labels {
+		var label []byte
+
+		label = protowire.AppendTag(label, 1, protowire.BytesType)
+		label = protowire.AppendString(label, l.Name)
+		label = protowire.AppendTag(label, 2, protowire.BytesType)
+		label = protowire.AppendString(label, l.Value)
+
+		series = protowire.AppendTag(series, 1, protowire.BytesType)
+		series = protowire.AppendBytes(series, label)
+	}
+
+	var sample []byte
+
+	sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+	sample = protowire.AppendFixed64(sample, math.Float64bits(v))
+	sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+	sample = protowire.AppendVarint(sample, uint64(ts))
+
+	series = protowire.AppendTag(series, 2, protowire.BytesType)
+	series = protowire.AppendBytes(series, sample)
+
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+
+	return protowire.AppendBytes(b, series)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// Returns the time series of a decoded write request as map from the series in
+// text format, e.g. pdc_up{instance="a"}, to its only sample.
+func decodeWriteRequest(t *testing.T, b []byte) map[string]prompb.Sample {
+	t.Helper()
+
+	var req prompb.WriteRequest
+
+	if err := req.Unmarshal(b); err != nil {
+		t.Fatal(err)
+	}
+
+	series := map[string]prompb.Sample{}
+
+	for _, ts := range req.Timeseries {
+		if len(ts.Samples) != 1 {
+			t.Fatalf("series %v has %d samples, want 1", ts.Labels, len(ts.Samples))
+		}
+
+		if !slices.IsSortedFunc(ts.Labels, func(a, b prompb.Label) int { return strings.Compare(a.Name, b.Name) }) {
+			t.Errorf("labels %v are not sorted", ts.Labels)
+		}
+
+		var (
+			name   string
+			labels []string
+		)
+
+		for _, l := range ts.Labels {
+			if l.Name == "__name__" {
+				name = l.Value
+			} else {
+				labels = append(labels, l.Name+`="`+l.Value+`"`)
+			}
+		}
+
+		series[name+"{"+strings.Join(labels, ",")+"}"] = ts.Samples[0]
+	}
+
+	return series
+}
+
+func TestAppendTimeSeries(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels []labelPair
+		v      float64
+		ts     int64
+	}{
+		{"single label", []labelPair{{"__name__", "pdc_up"}}, 1, 1717245307000},
+		{"labels", []labelPair{{"__name__", "pdc_battery_voltage"}, {"name", "Garage"}, {"serialno", "92632105100000"}}, 52.6, 1717245307000},
+		{"empty value", []labelPair{{"__name__", "pdc_info"}, {"name", ""}}, 1, 1},
+		{"negative", []labelPair{{"__name__", "pdc_battery_power_watts"}}, -1250.5, 1717245307000},
+		{"infinity", []labelPair{{"__name__", "pdc_bucket"}}, math.Inf(1), 1717245307000},
+		{"stale marker", []labelPair{{"__name__", "pdc_up"}}, math.Float64frombits(0x7ff0000000000002), 1717245307000},
+		{"no timestamp", []labelPair{{"__name__", "pdc_up"}}, 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// A second series checks that series are appended as separate messages
+			b := appendTimeSeries(nil, tt.labels, tt.v, tt.ts)
+			b = appendTimeSeries(b, []labelPair{{"__name__", "pdc_next"}}, 2, 3)
+
+			var req prompb.WriteRequest
+
+			if err := req.Unmarshal(b); err != nil {
+				t.Fatal(err)
+			}
+
+			if len(req.Timeseries) != 2 {
+				t.Fatalf("time series = %d, want 2", len(req.Timeseries))
+			}
+
+			ts := req.Timeseries[0]
+
+			if len(ts.Labels) != len(tt.labels) {
+				t.Fatalf("labels = %v, want %v", ts.Labels, tt.labels)
+			}
+
+			for i, l := range ts.Labels {
+				if l.Name != tt.labels[i].Name || l.Value != tt.labels[i].Value {
+					t.Errorf("label %d = %s=%q, want %s=%q", i, l.Name, l.Value, tt.labels[i].Name, tt.labels[i].Value)
+				}
+			}
+
+			if len(ts.Samples) != 1 {
+				t.Fatalf("samples = %v, want 1", ts.Samples)
+			}
+
+			if s := ts.Samples[0]; math.Float64bits(s.Value) != math.Float64bits(tt.v) || s.Timestamp != tt.ts {
+				t.Errorf("sample = %v@%d, want %v@%d", s.Value, s.Timestamp, tt.v, tt.ts)
+			}
+
+			if s := req.Timeseries[1].Samples; len(s) != 1 || s[0].Value != 2 || s[0].Timestamp != 3 {
+				t.Errorf("second series samples = %v, want 2@3", s)
+			}
+		})
+	}
+}
+
+func TestEncodeWriteRequest(t *testing.T) {
+	const ts = 1717245307000
+
+	reg := prometheus.NewRegistry()
+
+	promauto.With(reg).NewCounter(prometheus.CounterOpts{Name: "pdc_counter_total", Help: "."}).Add(3)
+	promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{Name: "pdc_gauge", Help: "."}, []string{"serialno", "instance"}).
+		WithLabelValues("92632105100000", "pdc-1").Set(52.6)
+	promauto.With(reg).NewSummary(prometheus.SummaryOpts{Name: "pdc_summary", Help: ".", Objectives: map[float64]float64{0.5: 0.05}}).Observe(2)
+	promauto.With(reg).NewHistogram(prometheus.HistogramOpts{Name: "pdc_histogram", Help: ".", Buckets: []float64{1, 5}}).Observe(2)
+
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Metrics with a timestamp, e.g. with -metrics.timestamps, keep it
+	desc := prometheus.NewDesc("pdc_timestamped", ".", nil, nil)
+
+	treg := prometheus.NewRegistry()
+	treg.MustRegister(constCollector{
+		prometheus.NewMetricWithTimestamp(time.UnixMilli(ts-60000), prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 7)),
+	})
+
+	tmfs, err := treg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mfs = append(mfs, tmfs...)
+
+	b, samples := encodeWriteRequest(mfs, []labelPair{{"instance", "exporter"}, {"job", "pdc"}}, ts)
+
+	want := map[string]prompb.Sample{
+		`pdc_counter_total{instance="exporter",job="pdc"}`:                {Value: 3, Timestamp: ts},
+		`pdc_gauge{instance="pdc-1",job="pdc",serialno="92632105100000"}`: {Value: 52.6, Timestamp: ts},
+		`pdc_summary{instance="exporter",job="pdc",quantile="0.5"}`:       {Value: 2, Timestamp: ts},
+		`pdc_summary_sum{instance="exporter",job="pdc"}`:                  {Value: 2, Timestamp: ts},
+		`pdc_summary_count{instance="exporter",job="pdc"}`:                {Value: 1, Timestamp: ts},
+		`pdc_histogram_bucket{instance="exporter",job="pdc",le="1"}`:      {Value: 0, Timestamp: ts},
+		`pdc_histogram_bucket{instance="exporter",job="pdc",le="5"}`:      {Value: 1, Timestamp: ts},
+		`pdc_histogram_bucket{instance="exporter",job="pdc",le="+Inf"}`:   {Value: 1, Timestamp: ts},
+		`pdc_histogram_sum{instance="exporter",job="pdc"}`:                {Value: 2, Timestamp: ts},
+		`pdc_histogram_count{instance="exporter",job="pdc"}`:              {Value: 1, Timestamp: ts},
+		`pdc_timestamped{instance="exporter",job="pdc"}`:                  {Value: 7, Timestamp: ts - 60000},
+	}
+
+	if samples != len(want) {
+		t.Errorf("samples = %d, want %d", samples, len(want))
+	}
+
+	got := decodeWriteRequest(t, b)
+
+	for k, w := range want {
+		if s, ok := got[k]; !ok {
+			t.Errorf("missing series %s", k)
+		} else if s.Value != w.Value || s.Timestamp != w.Timestamp {
+			t.Errorf("series %s = %v@%d, want %v@%d", k, s.Value, s.Timestamp, w.Value, w.Timestamp)
+		}
+	}
+
+	for k := range got {
+		if _, ok := want[k]; !ok {
+			t.Errorf("unexpected series %s", k)
+		}
+	}
+}
+
+func TestRemoteWriterClose(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures int64
+		requests int64
+		dropped  bool
+	}{
+		{"endpoint available", 0, 2, false},
+		{"queued request is sent without waiting for the retry", 1, 3, false},
+		{"endpoint unavailable", math.MaxInt64, 2, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int64
+
+			received := make(chan struct{}, 10)
+
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if requests.Add(1) <= tt.failures {
+					http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				}
+
+				received <- struct{}{}
+			}))
+			defer srv.Close()
+
+			setFlag(t, remoteWriteURL, srv.URL)
+			setFlag(t, remoteWriteInstance, "exporter")
+
+			w, err := newRemoteWriter(&exporter{Reg: prometheus.NewRegistry()})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			go w.run(time.Hour)
+
+			select {
+			case <-received:
+			case <-time.After(10 * time.Second):
+				t.Fatal("no metrics pushed")
+			}
+
+			w.close()
+
+			if n := requests.Load(); n != tt.requests {
+				t.Errorf("requests = %d, want %d", n, tt.requests)
+			}
+
+			if len(w.Queue) != 0 {
+				t.Errorf("queued requests after closing = %d, want none", len(w.Queue))
+			}
+
+			var m dto.Metric
+
+			if err := w.DroppedSamples.Write(&m); err != nil {
+				t.Fatal(err)
+			}
+
+			if dropped := m.GetCounter().GetValue() > 0; dropped != tt.dropped {
+				t.Errorf("dropped samples = %v, want dropped %v", m.GetCounter().GetValue(), tt.dropped)
+			}
+		})
+	}
+}
+
+// constCollector collects a fixed metric
+type constCollector struct {
+	m prometheus.Metric
+}
+
+func (c constCollector) Describe(ch chan<- *prometheus.Desc) { ch <- c.m.Desc() }
+
+func (c constCollector) Collect(ch chan<- prometheus.Metric) { ch <- c.m }
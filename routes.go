@@ -14,18 +14,51 @@ func (e *exporter) routes() http.Handler {
 		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 	})
 
-	router.Handler(http.MethodGet, *metricsPath, promhttp.HandlerFor(e.Reg, promhttp.HandlerOpts{}))
+	// Without telemetry path the metrics are only pushed
+	if *metricsPath != "" {
+		router.Handler(http.MethodGet, *metricsPath, e.metricsHandler())
+	}
+
+	router.HandlerFunc(http.MethodGet, "/sd", e.serviceDiscovery)
+	router.HandlerFunc(http.MethodGet, "/api/events", e.events)
+	router.HandlerFunc(http.MethodGet, "/api/v1/devices", e.apiDevices)
+	router.HandlerFunc(http.MethodGet, "/api/v1/devices/:serial/workinfo", e.apiWorkInfo)
+	router.HandlerFunc(http.MethodGet, "/api/v1/devices/:serial/history", e.apiHistory)
+	router.HandlerFunc(http.MethodGet, "/api/v1/openapi.yaml", serveOpenAPI)
+
+	if e.Stream != nil {
+		router.HandlerFunc(http.MethodGet, "/api/v1/stream", e.Stream.serve)
+	}
+
+	if e.Storage != nil {
+		router.HandlerFunc(http.MethodGet, "/api/v1/devices/:serial/samples", e.Storage.serveSamples)
+		router.HandlerFunc(http.MethodGet, "/api/v1/devices/:serial/hourly", e.Storage.serveHourly)
+	}
+
 	router.HandlerFunc(http.MethodGet, "/healthz", func(w http.ResponseWriter, r *http.Request) { http.Error(w, "OK", http.StatusOK) })
-	router.HandlerFunc(http.MethodGet, "/", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte(`<html>
-		<head><title>power-datacenter Exporter</title></head>
-		<body>
-		<h1>power-datacenter Exporter</h1>
-		<p><a href="` + *metricsPath + `">Metrics</a></p>
-		</body>
-		</html>
-		`))
-	})
+	router.HandlerFunc(http.MethodGet, "/", e.dashboard)
+	router.Handler(http.MethodGet, "/assets/*filepath", dashboardAssets())
 
 	return router
 }
+
+// Serves all metrics, or only the metrics of a single device
+// if its serial number is passed in the target parameter.
+func (e *exporter) metricsHandler() http.Handler {
+	h := promhttp.HandlerFor(e.Reg, promhttp.HandlerOpts{})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target := r.URL.Query().Get("target")
+		if target == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		if e.device(target) == nil {
+			http.Error(w, "unknown target "+target, http.StatusNotFound)
+			return
+		}
+
+		promhttp.HandlerFor(targetGatherer(e.Reg, target), promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	})
+}
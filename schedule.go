@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Number of intervals between portal refreshes the cadence is estimated from
+	cadenceSamples = 5
+)
+
+// schedule learns the cadence the portal refreshes the data of a device with
+// and determines when the device should be polled next
+type schedule struct {
+	// DataID and Sampled identify the last data that was retrieved
+	DataID  float64
+	Sampled time.Time
+	// Intervals are the most recent intervals between refreshes
+	Intervals []time.Duration
+	// Cadence is the estimated refresh interval, zero until at least one interval was seen
+	Cadence time.Duration
+	// Backoff is the current delay between polls that returned no new data
+	Backoff time.Duration
+	// Next is the time the device should be polled next
+	Next time.Time
+}
+
+// Updates the schedule after the device was polled successfully at now, given the
+// data ID and sample time of the retrieved data. Returns true if the data is new.
+func (s *schedule) update(dataID float64, sampled, now time.Time, delay, maxInterval time.Duration) bool {
+	if dataID == s.DataID && sampled.Equal(s.Sampled) {
+		// No new data yet, poll again with an increasing delay
+		s.Backoff = min(max(s.Backoff*2, delay), maxInterval)
+		s.Next = now.Add(s.Backoff)
+
+		return false
+	}
+
+	if !s.Sampled.IsZero() && sampled.After(s.Sampled) {
+		s.Intervals = append(s.Intervals, sampled.Sub(s.Sampled))
+
+		if n := len(s.Intervals) - cadenceSamples; n > 0 {
+			s.Intervals = slices.Delete(s.Intervals, 0, n)
+		}
+
+		s.Cadence = median(s.Intervals)
+	}
+
+	s.DataID = dataID
+	s.Sampled = sampled
+	s.Backoff = 0
+
+	// Poll shortly after the next expected refresh. As long as the cadence is unknown,
+	// poll with an increasing delay to find the next refresh.
+	switch {
+	case s.Cadence == 0:
+		s.Next = now.Add(delay)
+	case sampled.Add(s.Cadence + delay).After(now):
+		s.Next = sampled.Add(s.Cadence + delay)
+	default:
+		s.Next = now.Add(delay)
+	}
+
+	// The expected refresh is based on the device clock, which may run ahead
+	if limit := now.Add(maxInterval); s.Next.After(limit) {
+		s.Next = limit
+	}
+
+	return true
+}
+
+// Updates the schedule after polling the device failed at now.
+func (s *schedule) failed(now time.Time, delay, maxInterval time.Duration) {
+	s.Backoff = min(max(s.Backoff*2, delay), maxInterval)
+	s.Next = now.Add(s.Backoff)
+}
+
+// Returns the median of the given durations.
+func median(d []time.Duration) time.Duration {
+	sorted := slices.Clone(d)
+	slices.Sort(sorted)
+
+	return sorted[len(sorted)/2]
+}
+
+// Polls every device when it is due according to its schedule, instead of on a fixed interval,
+// until the context is cancelled.
+func startAdaptivePolling(ctx context.Context, e *exporter) {
+	tmr := time.NewTimer(0)
+	defer tmr.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tmr.C:
+		}
+
+		now := time.Now()
+
+		err := e.pollDevices(func(d *device) bool {
+			return !d.Schedule.Next.After(now)
+		})
+		if err != nil {
+			log.Warnln(err)
+		}
+
+		var next time.Time
+
+		for _, d := range e.Devices {
+			if next.IsZero() || d.Schedule.Next.Before(next) {
+				next = d.Schedule.Next
+			}
+		}
+
+		if next.IsZero() {
+			next = time.Now().Add(time.Duration(*interval) * time.Second)
+		}
+
+		log.Debugln("Next poll at", next)
+
+		tmr.Reset(time.Until(next))
+	}
+}
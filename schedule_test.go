@@ -0,0 +1,137 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleUpdate(t *testing.T) {
+	t0 := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	const (
+		delay       = 15 * time.Second
+		maxInterval = time.Minute
+	)
+
+	type poll struct {
+		dataID  float64
+		sampled time.Time
+		now     time.Time
+		isNew   bool
+		next    time.Time
+	}
+
+	tests := []struct {
+		name    string
+		polls   []poll
+		cadence time.Duration
+	}{
+		{
+			name: "first data",
+			polls: []poll{
+				{1, t0, t0.Add(10 * time.Second), true, t0.Add(25 * time.Second)},
+			},
+		},
+		{
+			name: "no new data backs off up to the maximum interval",
+			polls: []poll{
+				{1, t0, t0, true, t0.Add(15 * time.Second)},
+				{1, t0, t0.Add(15 * time.Second), false, t0.Add(30 * time.Second)},
+				{1, t0, t0.Add(30 * time.Second), false, t0.Add(60 * time.Second)},
+				{1, t0, t0.Add(60 * time.Second), false, t0.Add(120 * time.Second)},
+				{1, t0, t0.Add(120 * time.Second), false, t0.Add(180 * time.Second)},
+			},
+		},
+		{
+			name: "polls after the expected refresh",
+			polls: []poll{
+				{1, t0, t0, true, t0.Add(15 * time.Second)},
+				{2, t0.Add(50 * time.Second), t0.Add(55 * time.Second), true, t0.Add(115 * time.Second)},
+			},
+			cadence: 50 * time.Second,
+		},
+		{
+			name: "overdue refresh polls after the delay",
+			polls: []poll{
+				{1, t0, t0, true, t0.Add(15 * time.Second)},
+				{2, t0.Add(40 * time.Second), t0.Add(100 * time.Second), true, t0.Add(115 * time.Second)},
+			},
+			cadence: 40 * time.Second,
+		},
+		{
+			name: "device clock ahead is limited to the maximum interval",
+			polls: []poll{
+				{1, t0.Add(3 * time.Hour), t0, true, t0.Add(15 * time.Second)},
+				{2, t0.Add(3*time.Hour + 5*time.Minute), t0.Add(15 * time.Second), true, t0.Add(75 * time.Second)},
+			},
+			cadence: 5 * time.Minute,
+		},
+		{
+			name: "long cadence is limited to the maximum interval",
+			polls: []poll{
+				{1, t0, t0, true, t0.Add(15 * time.Second)},
+				{2, t0.Add(5 * time.Minute), t0.Add(5*time.Minute + 5*time.Second), true, t0.Add(6*time.Minute + 5*time.Second)},
+			},
+			cadence: 5 * time.Minute,
+		},
+		{
+			name: "cadence is the median of recent intervals",
+			polls: []poll{
+				{1, t0, t0, true, t0.Add(15 * time.Second)},
+				{2, t0.Add(50 * time.Second), t0.Add(50 * time.Second), true, t0.Add(110 * time.Second)},
+				{3, t0.Add(150 * time.Second), t0.Add(150 * time.Second), true, t0.Add(210 * time.Second)},
+				{4, t0.Add(190 * time.Second), t0.Add(190 * time.Second), true, t0.Add(250 * time.Second)},
+			},
+			cadence: 50 * time.Second,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var s schedule
+
+			for i, p := range tt.polls {
+				if got := s.update(p.dataID, p.sampled, p.now, delay, maxInterval); got != p.isNew {
+					t.Errorf("poll %d: update() = %v, want %v", i, got, p.isNew)
+				}
+
+				if !s.Next.Equal(p.next) {
+					t.Errorf("poll %d: next = %v, want %v", i, s.Next.Sub(t0), p.next.Sub(t0))
+				}
+			}
+
+			if s.Cadence != tt.cadence {
+				t.Errorf("cadence = %v, want %v", s.Cadence, tt.cadence)
+			}
+		})
+	}
+}
+
+func TestMedian(t *testing.T) {
+	tests := []struct {
+		name string
+		d    []time.Duration
+		want time.Duration
+	}{
+		{"single", []time.Duration{5}, 5},
+		{"odd", []time.Duration{9, 1, 5}, 5},
+		{"even takes the upper", []time.Duration{4, 1, 3, 2}, 3},
+		{"outlier", []time.Duration{300, 300, 3600, 300, 290}, 300},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := append([]time.Duration(nil), tt.d...)
+
+			if got := median(tt.d); got != tt.want {
+				t.Errorf("median() = %v, want %v", got, tt.want)
+			}
+
+			for i := range d {
+				if d[i] != tt.d[i] {
+					t.Fatalf("median() modified its input to %v", tt.d)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+)
+
+// sdTargetGroup is a target group in the Prometheus HTTP service discovery format
+type sdTargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// Serves one target per device in the Prometheus HTTP service discovery format.
+// The target is the serial number of the device, which can be relabeled
+// into the target parameter of the metrics path for a per-device scrape.
+func (e *exporter) serviceDiscovery(w http.ResponseWriter, r *http.Request) {
+	e.mu.RLock()
+
+	groups := make([]sdTargetGroup, 0, len(e.Devices))
+
+	for _, d := range e.Devices {
+		l := map[string]string{
+			LabelSerialNumber: d.SerialNumber,
+		}
+
+		if mt := d.machineType(); mt != "" {
+			l[LabelMachineType] = mt
+		}
+
+		if d.Name != "" {
+			l[LabelDeviceName] = d.Name
+		}
+
+		for i, n := range extraLabels {
+			if v := d.LabelValues[i+1]; v != "" {
+				l[n] = v
+			}
+		}
+
+		groups = append(groups, sdTargetGroup{
+			Targets: []string{d.SerialNumber},
+			Labels:  l,
+		})
+	}
+
+	e.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(groups); err != nil {
+		log.Warnln("Error writing service discovery response:", err)
+	}
+}
+
+// Returns a gatherer that only returns the metrics of the device with the given serial number.
+func targetGatherer(g prometheus.Gatherer, serial string) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		mfs, err := g.Gather()
+		if err != nil {
+			return nil, err
+		}
+
+		var filtered []*dto.MetricFamily
+
+		for _, mf := range mfs {
+			var metrics []*dto.Metric
+
+			for _, m := range mf.GetMetric() {
+				for _, lp := range m.GetLabel() {
+					if lp.GetName() == LabelSerialNumber && lp.GetValue() == serial {
+						metrics = append(metrics, m)
+						break
+					}
+				}
+			}
+
+			if len(metrics) > 0 {
+				mf.Metric = metrics
+				filtered = append(filtered, mf)
+			}
+		}
+
+		return filtered, nil
+	})
+}
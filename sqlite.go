@@ -0,0 +1,6 @@
+//go:build cgo
+
+package main
+
+// The SQLite driver requires cgo, without it storage is unavailable
+import _ "github.com/mattn/go-sqlite3"
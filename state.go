@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// state is the tracked state of all devices, which is persisted across restarts
+type state struct {
+	Devices map[string]*deviceState `json:"devices"`
+	// Events are the most recent transitions of all devices, oldest first
+	Events []event `json:"events,omitempty"`
+}
+
+// deviceState is the tracked state of a single device
+type deviceState struct {
+	// Outages are the grid outages per utility line
+	Outages map[string]*outage `json:"outages,omitempty"`
+	// Overload tracks the overloads of the inverter output
+	Overload *outage `json:"overload,omitempty"`
+	// Enums are the tracked work mode, charge source and load source by kind
+	Enums map[string]*enumState `json:"enums,omitempty"`
+}
+
+// Updates the tracked state from the latest work info of the device
+// and persists the state on changes. Returns the events of the outages, overloads
+// and transitions, which are also added to the recent events.
+func (e *exporter) trackState(ctx context.Context, d *device) []event {
+	t := d.sampleTime()
+
+	e.mu.Lock()
+
+	ds := e.State.device(d.SerialNumber)
+
+	events := ds.trackOutages(ctx, d, t)
+	events = append(events, ds.trackOverload(ctx, d, t)...)
+
+	transitions, changed := ds.trackTransitions(ctx, d, t)
+	events = append(events, transitions...)
+
+	for _, ev := range events {
+		e.State.addEvent(ev)
+	}
+
+	e.mu.Unlock()
+
+	if changed || len(events) > 0 {
+		e.saveState()
+	}
+
+	return events
+}
+
+// Reads the state from the given path. An empty state is returned
+// if no path is given or the file does not exist yet.
+func loadState(path string) (*state, error) {
+	s := &state{
+		Devices: map[string]*deviceState{},
+	}
+
+	if path == "" {
+		return s, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, err
+	}
+
+	if s.Devices == nil {
+		s.Devices = map[string]*deviceState{}
+	}
+
+	return s, nil
+}
+
+// Writes the state to the given path, replacing the file atomically.
+func (s *state) save(path string) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, b)
+}
+
+// Returns the state of the device with the given serial number, creating it if needed.
+func (s *state) device(serial string) *deviceState {
+	ds, ok := s.Devices[serial]
+	if !ok {
+		ds = &deviceState{}
+		s.Devices[serial] = ds
+	}
+
+	return ds
+}
+
+// Writes data to a temporary file next to path and renames it,
+// so readers never see a partially written file.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestTrackState(t *testing.T) {
+	t0 := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	type step struct {
+		workMode string
+		lineLoss bool
+		t        time.Time
+		kinds    []string
+	}
+
+	tests := []struct {
+		name   string
+		steps  []step
+		events int
+	}{
+		{
+			name:  "first sample",
+			steps: []step{{"Line Mode", false, t0, nil}},
+		},
+		{
+			name: "work mode transition",
+			steps: []step{
+				{"Line Mode", false, t0, nil},
+				{"Battery Mode", false, t0.Add(time.Minute), []string{"work_mode"}},
+			},
+			events: 1,
+		},
+		{
+			name: "outage starts and ends",
+			steps: []step{
+				{"Line Mode", false, t0, nil},
+				{"Battery Mode", true, t0.Add(time.Minute), []string{"line_loss", "work_mode"}},
+				{"Battery Mode", true, t0.Add(2 * time.Minute), nil},
+				{"Line Mode", false, t0.Add(3 * time.Minute), []string{"line_loss", "work_mode"}},
+			},
+			events: 4,
+		},
+		{
+			name: "repeated sample",
+			steps: []step{
+				{"Line Mode", false, t0, nil},
+				{"Battery Mode", false, t0, nil},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &exporter{State: &state{Devices: map[string]*deviceState{}}}
+
+			for i, s := range tt.steps {
+				d := testDevice()
+				d.WorkInfo.WorkMode = s.workMode
+				d.WorkInfo.LineLoss1 = s.lineLoss
+				d.WorkInfo.Time.Time = s.t.UnixMilli()
+
+				var kinds []string
+
+				for _, ev := range e.trackState(context.Background(), d) {
+					kinds = append(kinds, ev.Kind)
+
+					if !ev.Time.Equal(s.t) || ev.SerialNumber != d.SerialNumber || ev.From == ev.To {
+						t.Errorf("step %d: event = %+v", i, ev)
+					}
+				}
+
+				if !slices.Equal(kinds, s.kinds) {
+					t.Errorf("step %d: event kinds = %v, want %v", i, kinds, s.kinds)
+				}
+			}
+
+			if len(e.State.Events) != tt.events {
+				t.Errorf("recorded events = %v, want %d", e.State.Events, tt.events)
+			}
+		})
+	}
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/marevers/power-datacenter-exporter/pkg/pdc"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Name of the SQLite driver, only registered in builds with cgo
+	sqliteDriver = "sqlite3"
+
+	// Number of samples that can be queued while a write is in progress
+	storageQueueSize = 1000
+
+	// Interval of removing data beyond the retention
+	storageCleanupInterval = time.Hour
+
+	// Maximum number of raw samples returned by a query
+	storageMaxSamples = 10000
+)
+
+// storageMigrations are applied in order to bring the database to the latest schema.
+// The number of applied migrations is kept in the user_version of the database.
+var storageMigrations = []string{
+	`CREATE TABLE samples (
+		serialno  TEXT NOT NULL,
+		data_id   INTEGER,
+		sampled   INTEGER NOT NULL,
+		retrieved INTEGER NOT NULL,
+		workinfo  TEXT NOT NULL
+	);
+	CREATE UNIQUE INDEX samples_data_id ON samples (serialno, data_id);
+	CREATE INDEX samples_sampled ON samples (serialno, sampled);
+
+	CREATE TABLE hourly (
+		serialno TEXT NOT NULL,
+		hour     INTEGER NOT NULL,
+		field    TEXT NOT NULL,
+		samples  INTEGER NOT NULL,
+		min      REAL NOT NULL,
+		max      REAL NOT NULL,
+		mean     REAL NOT NULL,
+		PRIMARY KEY (serialno, hour, field)
+	);`,
+	// The data ID was aggregated as if it were a reading
+	`DELETE FROM hourly WHERE field = 'data_id';`,
+}
+
+// storageAggregate recalculates the hourly aggregates of the readings, given as JSON array,
+// of a device in the hour starting at the given Unix time. Booleans are aggregated
+// as 0 and 1, so their mean is the fraction of samples they were true.
+const storageAggregate = `INSERT OR REPLACE INTO hourly (serialno, hour, field, samples, min, max, mean)
+	SELECT serialno, ?2, key, count(*), min(v), max(v), avg(v) FROM (
+		SELECT s.serialno, j.key, CASE j.type WHEN 'true' THEN 1.0 WHEN 'false' THEN 0.0 ELSE j.value END AS v
+		FROM samples s, json_each(s.workinfo) j
+		WHERE s.serialno = ?1 AND s.sampled >= ?2 AND s.sampled < ?2 + 3600
+			AND j.key IN (SELECT value FROM json_each(?3))
+			AND j.type IN ('integer', 'real', 'true', 'false')
+	)
+	GROUP BY key`
+
+// storageReadings is the JSON array of the numeric and boolean fields of the work info that
+// are aggregated. The data ID identifies a sample and is not a reading.
+var storageReadings = func() string {
+	var names []string
+
+	for _, f := range workInfoFields(&pdc.WorkInfo{}) {
+		switch f.Value.(type) {
+		case float64, bool:
+			if f.Name != "data_id" {
+				names = append(names, f.Name)
+			}
+		}
+	}
+
+	b, _ := json.Marshal(names)
+
+	return string(b)
+}()
+
+// storagePublisher appends every new work info to a SQLite database and keeps hourly
+// aggregates of the readings. Raw samples are removed after the raw retention,
+// aggregates after the hourly retention if set.
+type storagePublisher struct {
+	DB *sql.DB
+
+	Samples chan storageSample
+	Stopped chan struct{}
+
+	WrittenSamples prometheus.Counter
+	WriteErrors    prometheus.Counter
+}
+
+// Returns a publisher for the database at the storage path, migrated to the latest schema,
+// and starts writing.
+func newStoragePublisher(reg prometheus.Registerer) (*storagePublisher, error) {
+	if !slices.Contains(sql.Drivers(), sqliteDriver) {
+		return nil, errors.New("SQLite storage requires a build with cgo")
+	}
+
+	db, err := sql.Open(sqliteDriver, "file:"+*storagePath+"?_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := migrateStorage(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error migrating database: %w", err)
+	}
+
+	p := &storagePublisher{
+		DB:      db,
+		Samples: make(chan storageSample, storageQueueSize),
+		Stopped: make(chan struct{}),
+	}
+
+	p.WrittenSamples = promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name:      "storage_samples_written_total",
+		Namespace: Namespace,
+		Help:      "Number of samples written to the storage database",
+	})
+
+	p.WriteErrors = promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name:      "storage_write_errors_total",
+		Namespace: Namespace,
+		Help:      "Number of samples that could not be written to the storage database",
+	})
+
+	go p.run()
+
+	return p, nil
+}
+
+// Applies the migrations that were not applied to the database yet.
+func migrateStorage(db *sql.DB) error {
+	var version int
+
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+
+	for i := version; i < len(storageMigrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(storageMigrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+
+		// PRAGMA does not support parameters
+		if _, err := tx.Exec("PRAGMA user_version = " + strconv.Itoa(i+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+
+		log.Infoln("Applied storage migration", i+1)
+	}
+
+	return nil
+}
+
+// storageSample is a sample queued for writing with the serial number of its device
+type storageSample struct {
+	SerialNumber string
+	sample
+}
+
+func (p *storagePublisher) publish(d *device) {
+	s := storageSample{
+		SerialNumber: d.SerialNumber,
+		sample:       sample{Sampled: d.sampleTime(), Retrieved: d.Retrieved, WorkInfo: d.WorkInfo},
+	}
+
+	select {
+	case p.Samples <- s:
+	default:
+		log.Warnln("Storage writer is busy, dropped sample of", d.SerialNumber)
+		p.WriteErrors.Inc()
+	}
+}
+
+// Writes the queued samples and removes data beyond the retention until the publisher is closed.
+func (p *storagePublisher) run() {
+	defer close(p.Stopped)
+
+	p.cleanup()
+
+	tck := time.NewTicker(storageCleanupInterval)
+	defer tck.Stop()
+
+	for {
+		select {
+		case s, ok := <-p.Samples:
+			if !ok {
+				return
+			}
+
+			if err := p.write(s); err != nil {
+				log.Warnln("Error writing sample of", s.SerialNumber, "to storage:", err)
+				p.WriteErrors.Inc()
+			}
+		case <-tck.C:
+			p.cleanup()
+		}
+	}
+}
+
+// Inserts the sample unless a sample with the same data ID is stored,
+// and updates the aggregates of its hour.
+func (p *storagePublisher) write(s storageSample) error {
+	serial := s.SerialNumber
+
+	wi, err := json.Marshal(newAPISample(s.sample).WorkInfo)
+	if err != nil {
+		return err
+	}
+
+	// Samples without data ID are not deduplicated, as NULL values are distinct
+	var dataID any
+	if s.WorkInfo.DataID != 0 {
+		dataID = int64(s.WorkInfo.DataID)
+	}
+
+	tx, err := p.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	res, err := tx.Exec("INSERT OR IGNORE INTO samples (serialno, data_id, sampled, retrieved, workinfo) VALUES (?, ?, ?, ?, ?)",
+		serial, dataID, s.Sampled.Unix(), s.Retrieved.Unix(), string(wi))
+	if err != nil {
+		return err
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		log.Debugln("Sample", dataID, "of", serial, "is already stored")
+		return nil
+	}
+
+	if _, err := tx.Exec(storageAggregate, serial, s.Sampled.Unix()/3600*3600, storageReadings); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	p.WrittenSamples.Inc()
+
+	return nil
+}
+
+// Removes the raw samples and aggregates beyond their retention.
+func (p *storagePublisher) cleanup() {
+	now := time.Now()
+
+	if *storageRawRetention > 0 {
+		res, err := p.DB.Exec("DELETE FROM samples WHERE sampled < ?", now.Add(-*storageRawRetention).Unix())
+		if err != nil {
+			log.Warnln("Error removing samples beyond the raw retention:", err)
+		} else if n, _ := res.RowsAffected(); n > 0 {
+			log.Infoln("Removed", n, "samples beyond the raw retention")
+		}
+	}
+
+	if *storageHourlyRetention > 0 {
+		res, err := p.DB.Exec("DELETE FROM hourly WHERE hour < ?", now.Add(-*storageHourlyRetention).Unix())
+		if err != nil {
+			log.Warnln("Error removing aggregates beyond the hourly retention:", err)
+		} else if n, _ := res.RowsAffected(); n > 0 {
+			log.Infoln("Removed", n, "hourly aggregates beyond the hourly retention")
+		}
+	}
+}
+
+func (p *storagePublisher) close() {
+	close(p.Samples)
+	<-p.Stopped
+
+	if err := p.DB.Close(); err != nil {
+		log.Warnln("Error closing storage database:", err)
+	}
+}
+
+// storageAggregateRow is an hourly aggregate of a reading in the API
+type storageAggregateRow struct {
+	Hour    time.Time `json:"hour"`
+	Field   string    `json:"field"`
+	Samples int       `json:"samples"`
+	Min     float64   `json:"min"`
+	Max     float64   `json:"max"`
+	Mean    float64   `json:"mean"`
+}
+
+// Returns the time range of the from and to query parameters, see parseSince.
+// The range defaults to everything up to now.
+func storageRange(r *http.Request) (from, to time.Time, err error) {
+	now := time.Now()
+
+	from, to = time.Unix(0, 0), now
+
+	if s := r.URL.Query().Get("from"); s != "" {
+		if from, err = parseSince(s, now); err != nil {
+			return from, to, fmt.Errorf("invalid from %s", s)
+		}
+	}
+
+	if s := r.URL.Query().Get("to"); s != "" {
+		if to, err = parseSince(s, now); err != nil {
+			return from, to, fmt.Errorf("invalid to %s", s)
+		}
+	}
+
+	return from, to, nil
+}
+
+// Serves the stored samples of a device sampled in the requested range, oldest first.
+// At most storageMaxSamples are returned, the limit parameter lowers this.
+func (p *storagePublisher) serveSamples(w http.ResponseWriter, r *http.Request) {
+	serial := httprouter.ParamsFromContext(r.Context()).ByName("serial")
+
+	from, to, err := storageRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	limit := storageMaxSamples
+
+	if l := r.URL.Query().Get("limit"); l != "" {
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 0 {
+			http.Error(w, "invalid limit "+l, http.StatusBadRequest)
+			return
+		}
+
+		limit = min(limit, storageMaxSamples)
+	}
+
+	rows, err := p.DB.QueryContext(r.Context(),
+		"SELECT sampled, retrieved, workinfo FROM samples WHERE serialno = ? AND sampled >= ? AND sampled < ? ORDER BY sampled LIMIT ?",
+		serial, from.Unix(), to.Unix(), limit)
+	if err != nil {
+		log.Warnln("Error querying stored samples:", err)
+		http.Error(w, "error querying stored samples", http.StatusInternalServerError)
+		return
+	}
+
+	defer rows.Close()
+
+	samples := []apiSample{}
+
+	for rows.Next() {
+		var (
+			sampled, retrieved int64
+			wi                 string
+			s                  apiSample
+		)
+
+		if err := rows.Scan(&sampled, &retrieved, &wi); err != nil {
+			log.Warnln("Error reading stored sample:", err)
+			http.Error(w, "error reading stored samples", http.StatusInternalServerError)
+			return
+		}
+
+		if err := json.Unmarshal([]byte(wi), &s.WorkInfo); err != nil {
+			log.Warnln("Error decoding stored sample:", err)
+			continue
+		}
+
+		s.Sampled, s.Retrieved = time.Unix(sampled, 0), time.Unix(retrieved, 0)
+		samples = append(samples, s)
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Warnln("Error reading stored samples:", err)
+		http.Error(w, "error reading stored samples", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, samples)
+}
+
+// Serves the hourly aggregates of a device in the requested range, oldest first.
+// The optional field parameter selects a single reading, e.g. battery_voltage.
+func (p *storagePublisher) serveHourly(w http.ResponseWriter, r *http.Request) {
+	serial := httprouter.ParamsFromContext(r.Context()).ByName("serial")
+
+	from, to, err := storageRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	field := r.URL.Query().Get("field")
+
+	rows, err := p.DB.QueryContext(r.Context(),
+		`SELECT hour, field, samples, min, max, mean FROM hourly
+		WHERE serialno = ? AND hour >= ? AND hour < ? AND (? = '' OR field = ?)
+		ORDER BY hour, field`,
+		serial, from.Unix()/3600*3600, to.Unix(), field, field)
+	if err != nil {
+		log.Warnln("Error querying hourly aggregates:", err)
+		http.Error(w, "error querying hourly aggregates", http.StatusInternalServerError)
+		return
+	}
+
+	defer rows.Close()
+
+	aggregates := []storageAggregateRow{}
+
+	for rows.Next() {
+		var (
+			hour int64
+			a    storageAggregateRow
+		)
+
+		if err := rows.Scan(&hour, &a.Field, &a.Samples, &a.Min, &a.Max, &a.Mean); err != nil {
+			log.Warnln("Error reading hourly aggregate:", err)
+			http.Error(w, "error reading hourly aggregates", http.StatusInternalServerError)
+			return
+		}
+
+		a.Hour = time.Unix(hour, 0)
+		aggregates = append(aggregates, a)
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Warnln("Error reading hourly aggregates:", err)
+		http.Error(w, "error reading hourly aggregates", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, aggregates)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Returns a publisher storing to a new database in a temporary directory.
+func newTestStoragePublisher(t *testing.T) *storagePublisher {
+	t.Helper()
+
+	if !slices.Contains(sql.Drivers(), sqliteDriver) {
+		t.Skip("SQLite storage requires a build with cgo")
+	}
+
+	setFlag(t, storagePath, filepath.Join(t.TempDir(), "pdc.db"))
+
+	p, err := newStoragePublisher(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(p.close)
+
+	return p
+}
+
+func TestStorageWrite(t *testing.T) {
+	t0 := time.Date(2024, 6, 1, 12, 35, 7, 0, time.UTC)
+
+	type write struct {
+		serialNo string
+		dataID   float64
+		sampled  time.Time
+		voltage  float64
+	}
+
+	tests := []struct {
+		name    string
+		writes  []write
+		samples int
+		hourly  map[string]float64
+	}{
+		{
+			name:    "single sample",
+			writes:  []write{{"92632105100000", 1, t0, 52}},
+			samples: 1,
+			hourly:  map[string]float64{"battery_voltage": 52},
+		},
+		{
+			name:    "stored under the device serial number",
+			writes:  []write{{"", 1, t0, 52}, {"other", 2, t0.Add(time.Minute), 54}},
+			samples: 2,
+			hourly:  map[string]float64{"battery_voltage": 53},
+		},
+		{
+			name:    "duplicate data ID",
+			writes:  []write{{"92632105100000", 1, t0, 52}, {"92632105100000", 1, t0.Add(time.Minute), 54}},
+			samples: 1,
+			hourly:  map[string]float64{"battery_voltage": 52},
+		},
+		{
+			name:    "samples without data ID",
+			writes:  []write{{"92632105100000", 0, t0, 52}, {"92632105100000", 0, t0.Add(time.Minute), 54}},
+			samples: 2,
+			hourly:  map[string]float64{"battery_voltage": 53},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestStoragePublisher(t)
+
+			for _, w := range tt.writes {
+				d := testDevice()
+				d.WorkInfo.SerialNo = w.serialNo
+				d.WorkInfo.DataID = w.dataID
+				d.WorkInfo.BatVoltage = w.voltage
+
+				s := storageSample{
+					SerialNumber: d.SerialNumber,
+					sample:       sample{Sampled: w.sampled, Retrieved: w.sampled, WorkInfo: d.WorkInfo},
+				}
+
+				if err := p.write(s); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var samples int
+
+			if err := p.DB.QueryRow("SELECT count(*) FROM samples WHERE serialno = ?", "92632105100000").Scan(&samples); err != nil {
+				t.Fatal(err)
+			}
+
+			if samples != tt.samples {
+				t.Errorf("samples = %d, want %d", samples, tt.samples)
+			}
+
+			mean := map[string]float64{}
+
+			rows, err := p.DB.Query("SELECT field, mean FROM hourly WHERE serialno = ? AND hour = ?", "92632105100000", t0.Truncate(time.Hour).Unix())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer rows.Close()
+
+			for rows.Next() {
+				var (
+					field string
+					v     float64
+				)
+
+				if err := rows.Scan(&field, &v); err != nil {
+					t.Fatal(err)
+				}
+
+				mean[field] = v
+			}
+
+			for field, want := range tt.hourly {
+				if mean[field] != want {
+					t.Errorf("hourly mean of %s = %v, want %v", field, mean[field], want)
+				}
+			}
+
+			if _, ok := mean["has_load"]; !ok {
+				t.Errorf("hourly fields = %v, want the boolean readings", mean)
+			}
+
+			for _, field := range []string{"data_id", "serial_no", "work_mode", "timestr"} {
+				if _, ok := mean[field]; ok {
+					t.Errorf("hourly fields = %v, want no %s", mean, field)
+				}
+			}
+		})
+	}
+}
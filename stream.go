@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Interval of the comments that keep idle streams open through proxies
+	streamHeartbeatInterval = 15 * time.Second
+
+	// Server-Sent Events event names
+	streamEventWorkInfo   = "workinfo"
+	streamEventTransition = "transition"
+)
+
+// streamEvent is a Server-Sent Event with JSON data
+type streamEvent struct {
+	Name         string
+	SerialNumber string
+	Data         []byte
+}
+
+// streamClient is a connected stream, optionally filtered to a single device
+type streamClient struct {
+	SerialNumber string
+	Events       chan streamEvent
+	// Done is closed when the broker disconnects the client
+	Done chan struct{}
+}
+
+// streamBroker pushes the work info of every device and the events of the state tracker
+// to the connected stream clients. Clients that do not keep up with their buffer are disconnected.
+type streamBroker struct {
+	Exporter *exporter
+
+	Clients map[*streamClient]struct{}
+	mu      sync.Mutex
+
+	ClientsGauge prometheus.Gauge
+}
+
+// Returns a broker for the stream endpoint.
+func newStreamBroker(e *exporter) *streamBroker {
+	return &streamBroker{
+		Exporter: e,
+		Clients:  map[*streamClient]struct{}{},
+		ClientsGauge: promauto.With(e.Reg).NewGauge(prometheus.GaugeOpts{
+			Name:      "stream_clients",
+			Namespace: Namespace,
+			Help:      "Number of clients connected to the event stream",
+		}),
+	}
+}
+
+func (b *streamBroker) publish(d *device) {
+	data, err := json.Marshal(newAPIWorkInfo(d))
+	if err != nil {
+		log.Warnln("Error encoding stream event:", err)
+		return
+	}
+
+	b.send([]streamEvent{{Name: streamEventWorkInfo, SerialNumber: d.SerialNumber, Data: data}})
+}
+
+// Pushes the outages and transitions recorded by the state tracker as transition events.
+func (b *streamBroker) publishEvents(evs []event) {
+	var events []streamEvent
+
+	for _, ev := range evs {
+		data, err := json.Marshal(ev)
+		if err != nil {
+			log.Warnln("Error encoding stream event:", err)
+			continue
+		}
+
+		events = append(events, streamEvent{Name: streamEventTransition, SerialNumber: ev.SerialNumber, Data: data})
+	}
+
+	b.send(events)
+}
+
+// Queues the events for the clients, disconnecting the clients whose buffer is full.
+func (b *streamBroker) send(events []streamEvent) {
+	if len(events) == 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+clients:
+	for c := range b.Clients {
+		for _, ev := range events {
+			if c.SerialNumber != "" && c.SerialNumber != ev.SerialNumber {
+				continue
+			}
+
+			select {
+			case c.Events <- ev:
+			default:
+				log.Warnln("Disconnecting stream client that fell behind")
+				b.remove(c)
+
+				continue clients
+			}
+		}
+	}
+}
+
+// Removes the client. The broker must be locked.
+func (b *streamBroker) remove(c *streamClient) {
+	if _, ok := b.Clients[c]; !ok {
+		return
+	}
+
+	delete(b.Clients, c)
+	close(c.Done)
+
+	b.ClientsGauge.Set(float64(len(b.Clients)))
+}
+
+// Serves the work info and transitions as Server-Sent Events. The latest work info
+// of every device is sent on connect. The optional serialno parameter filters the
+// events of a single device.
+func (b *streamBroker) serve(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	c := &streamClient{
+		SerialNumber: r.URL.Query().Get(LabelSerialNumber),
+		Events:       make(chan streamEvent, *streamBufferSize),
+		Done:         make(chan struct{}),
+	}
+
+	if c.SerialNumber != "" && b.Exporter.device(c.SerialNumber) == nil {
+		http.Error(w, "unknown device "+c.SerialNumber, http.StatusNotFound)
+		return
+	}
+
+	b.mu.Lock()
+
+	if len(b.Clients) >= *streamMaxClients {
+		b.mu.Unlock()
+
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "too many stream clients", http.StatusServiceUnavailable)
+
+		return
+	}
+
+	b.Clients[c] = struct{}{}
+	b.ClientsGauge.Set(float64(len(b.Clients)))
+
+	b.mu.Unlock()
+
+	defer func() {
+		b.mu.Lock()
+		b.remove(c)
+		b.mu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Disables response buffering in nginx
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	for _, ev := range b.snapshots(c.SerialNumber) {
+		if err := writeStreamEvent(w, ev); err != nil {
+			return
+		}
+	}
+
+	flusher.Flush()
+
+	tck := time.NewTicker(streamHeartbeatInterval)
+	defer tck.Stop()
+
+	for {
+		var err error
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-c.Done:
+			return
+		case ev := <-c.Events:
+			err = writeStreamEvent(w, ev)
+		case <-tck.C:
+			_, err = fmt.Fprint(w, ": heartbeat\n\n")
+		}
+
+		if err != nil {
+			return
+		}
+
+		flusher.Flush()
+	}
+}
+
+// Returns the work info events of the devices that were retrieved, or of the given device.
+func (b *streamBroker) snapshots(serial string) []streamEvent {
+	e := b.Exporter
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	var events []streamEvent
+
+	for _, d := range e.Devices {
+		if d.Retrieved.IsZero() || (serial != "" && d.SerialNumber != serial) {
+			continue
+		}
+
+		data, err := json.Marshal(newAPIWorkInfo(d))
+		if err != nil {
+			log.Warnln("Error encoding stream event:", err)
+			continue
+		}
+
+		events = append(events, streamEvent{Name: streamEventWorkInfo, SerialNumber: d.SerialNumber, Data: data})
+	}
+
+	return events
+}
+
+// Writes a Server-Sent Event. The JSON data does not contain newlines.
+func writeStreamEvent(w http.ResponseWriter, ev streamEvent) error {
+	_, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Name, ev.Data)
+	return err
+}
+
+func (b *streamBroker) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for c := range b.Clients {
+		b.remove(c)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestStreamOverload(t *testing.T) {
+	t0 := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	type step struct {
+		overload bool
+		t        time.Time
+		// want is the from and to of the streamed overload event, empty if none is streamed
+		want []string
+	}
+
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name:  "no overload",
+			steps: []step{{false, t0, nil}, {false, t0.Add(time.Minute), nil}},
+		},
+		{
+			name: "overload starts and ends",
+			steps: []step{
+				{false, t0, nil},
+				{true, t0.Add(time.Minute), []string{"false", "true"}},
+				{true, t0.Add(2 * time.Minute), nil},
+				{false, t0.Add(3 * time.Minute), []string{"true", "false"}},
+			},
+		},
+		{
+			name:  "overloaded on the first sample",
+			steps: []step{{true, t0, []string{"false", "true"}}, {true, t0.Add(time.Minute), nil}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &exporter{
+				Reg:   prometheus.NewRegistry(),
+				State: &state{Devices: map[string]*deviceState{}},
+			}
+			e.Stream = newStreamBroker(e)
+
+			c := &streamClient{Events: make(chan streamEvent, 8), Done: make(chan struct{})}
+			e.Stream.Clients[c] = struct{}{}
+
+			for i, s := range tt.steps {
+				d := testDevice()
+				d.WorkInfo.OverLoad = s.overload
+				d.WorkInfo.Time.Time = s.t.UnixMilli()
+
+				e.Stream.publishEvents(e.trackState(context.Background(), d))
+
+				var streamed []event
+
+				for len(c.Events) > 0 {
+					ev := <-c.Events
+
+					var tr event
+					if err := json.Unmarshal(ev.Data, &tr); err != nil {
+						t.Fatal(err)
+					}
+
+					if ev.Name != streamEventTransition || ev.SerialNumber != d.SerialNumber {
+						t.Errorf("step %d: streamed %s event of %s", i, ev.Name, ev.SerialNumber)
+					}
+
+					streamed = append(streamed, tr)
+				}
+
+				if s.want == nil {
+					if len(streamed) != 0 {
+						t.Errorf("step %d: streamed %v, want nothing", i, streamed)
+					}
+
+					continue
+				}
+
+				want := event{Time: s.t, SerialNumber: d.SerialNumber, Kind: "overload", From: s.want[0], To: s.want[1]}
+
+				if len(streamed) != 1 || !streamed[0].Time.Equal(want.Time) || streamed[0].Kind != want.Kind ||
+					streamed[0].From != want.From || streamed[0].To != want.To || streamed[0].SerialNumber != want.SerialNumber {
+					t.Errorf("step %d: streamed %+v, want %+v", i, streamed, want)
+				}
+			}
+		})
+	}
+}
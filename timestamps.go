@@ -0,0 +1,115 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+)
+
+// timestampCollector collects the registered device metrics with the time the latest
+// work info was sampled on the device, instead of the time of the scrape.
+// It is used as registerer for the device metrics when timestamps are enabled.
+type timestampCollector struct {
+	e          *exporter
+	collectors []prometheus.Collector
+}
+
+func newTimestampCollector(e *exporter) *timestampCollector {
+	return &timestampCollector{
+		e: e,
+	}
+}
+
+func (c *timestampCollector) Register(col prometheus.Collector) error {
+	c.collectors = append(c.collectors, col)
+
+	return nil
+}
+
+func (c *timestampCollector) MustRegister(cols ...prometheus.Collector) {
+	c.collectors = append(c.collectors, cols...)
+}
+
+func (c *timestampCollector) Unregister(col prometheus.Collector) bool {
+	for i, cc := range c.collectors {
+		if cc == col {
+			c.collectors = append(c.collectors[:i], c.collectors[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *timestampCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, col := range c.collectors {
+		col.Describe(ch)
+	}
+}
+
+func (c *timestampCollector) Collect(ch chan<- prometheus.Metric) {
+	now := time.Now()
+	maxAge := time.Duration(*timestampMaxAge) * time.Second
+
+	timestamps := map[string]time.Time{}
+
+	c.e.mu.RLock()
+
+	for _, d := range c.e.Devices {
+		t := d.WorkInfo.SampleTime()
+
+		// Samples in the future due to clock skew are capped at the current time, samples
+		// older than the maximum age are exposed without timestamp as Prometheus would reject them
+		switch {
+		case t.IsZero() || now.Sub(t) > maxAge:
+			continue
+		case t.After(now):
+			t = now
+		}
+
+		timestamps[d.SerialNumber] = t
+	}
+
+	c.e.mu.RUnlock()
+
+	inner := make(chan prometheus.Metric)
+
+	go func() {
+		for _, col := range c.collectors {
+			col.Collect(inner)
+		}
+
+		close(inner)
+	}()
+
+	for m := range inner {
+		t, ok := timestamps[metricSerialNumber(m)]
+		if !ok {
+			ch <- m
+			continue
+		}
+
+		ch <- prometheus.NewMetricWithTimestamp(t, m)
+	}
+}
+
+// Returns the value of the serial number label of the metric.
+func metricSerialNumber(m prometheus.Metric) string {
+	var pm dto.Metric
+
+	if err := m.Write(&pm); err != nil {
+		log.Debugln("Error reading metric:", err)
+		return ""
+	}
+
+	for _, lp := range pm.GetLabel() {
+		if lp.GetName() == LabelSerialNumber {
+			return lp.GetValue()
+		}
+	}
+
+	return ""
+}
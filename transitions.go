@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// LabelFrom represents the value before a transition
+	LabelFrom = "from"
+
+	// LabelTo represents the value after a transition
+	LabelTo = "to"
+
+	// Maximum number of events that are kept
+	maxEvents = 100
+
+	// Gaps between samples longer than this are not counted as time spent in a value,
+	// e.g. after the exporter or the portal was down
+	maxSampleGap = time.Hour
+)
+
+// enumState tracks the value of a named status over time
+type enumState struct {
+	// Value is the value of the last sample, taken at Sampled
+	Value   string    `json:"value"`
+	Sampled time.Time `json:"sampled"`
+	// Seconds is the time spent in each value
+	Seconds map[string]float64 `json:"seconds"`
+	// Transitions is the number of transitions from one value to another
+	Transitions map[string]map[string]float64 `json:"transitions"`
+}
+
+// event is a transition of a named status of a device, or the start or end of a grid outage or overload
+type event struct {
+	Time         time.Time `json:"time"`
+	SerialNumber string    `json:"serialno"`
+	Kind         string    `json:"kind"`
+	From         string    `json:"from"`
+	To           string    `json:"to"`
+}
+
+// Updates the value sampled at the given time, counting the time since the previous
+// sample for the previous value. Samples that are not newer than the previous one are ignored.
+// Returns whether the state was updated and whether the value changed.
+func (es *enumState) update(v string, t time.Time) (updated, transition bool) {
+	if !t.After(es.Sampled) {
+		return false, false
+	}
+
+	if es.Seconds == nil {
+		es.Seconds = map[string]float64{}
+		es.Transitions = map[string]map[string]float64{}
+	}
+
+	first := es.Sampled.IsZero()
+
+	if gap := t.Sub(es.Sampled); !first && gap <= maxSampleGap {
+		es.Seconds[es.Value] += gap.Seconds()
+	}
+
+	if _, ok := es.Seconds[v]; !ok {
+		es.Seconds[v] = 0
+	}
+
+	transition = !first && v != es.Value
+
+	if transition {
+		if es.Transitions[es.Value] == nil {
+			es.Transitions[es.Value] = map[string]float64{}
+		}
+
+		es.Transitions[es.Value][v]++
+	}
+
+	es.Value = v
+	es.Sampled = t
+
+	return true, transition
+}
+
+// Updates the named statuses of the device from its latest work info sampled at the given time.
+// Returns an event for every transition and whether the state changed.
+func (ds *deviceState) trackTransitions(ctx context.Context, d *device, t time.Time) ([]event, bool) {
+	if ds.Enums == nil {
+		ds.Enums = map[string]*enumState{}
+	}
+
+	var events []event
+
+	changed := false
+
+	for _, k := range enumKinds {
+		es, ok := ds.Enums[k.Name]
+		if !ok {
+			es = &enumState{}
+			ds.Enums[k.Name] = es
+		}
+
+		from := es.Value
+		to := k.Value(&d.WorkInfo)
+
+		updated, transition := es.update(to, t)
+		if updated {
+			changed = true
+		}
+
+		if transition {
+			log.WithContext(ctx).Infoln("Transition of", k.Description, "of", d.SerialNumber, "from", from, "to", to)
+
+			events = append(events, event{
+				Time:         t,
+				SerialNumber: d.SerialNumber,
+				Kind:         k.Name,
+				From:         from,
+				To:           to,
+			})
+		}
+	}
+
+	return events, changed
+}
+
+// Adds an event, dropping the oldest ones if there are more than maxEvents.
+func (s *state) addEvent(ev event) {
+	s.Events = append(s.Events, ev)
+
+	if n := len(s.Events) - maxEvents; n > 0 {
+		s.Events = slices.Delete(s.Events, 0, n)
+	}
+}
+
+// Serves the most recent events, newest first. The optional serialno parameter
+// filters the events of a single device and limit sets the maximum number of events.
+func (e *exporter) events(w http.ResponseWriter, r *http.Request) {
+	serial := r.URL.Query().Get(LabelSerialNumber)
+
+	limit := maxEvents
+
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 0 {
+			http.Error(w, "invalid limit "+l, http.StatusBadRequest)
+			return
+		}
+	}
+
+	events := []event{}
+
+	e.mu.RLock()
+
+	for i := len(e.State.Events) - 1; i >= 0 && len(events) < limit; i-- {
+		if ev := e.State.Events[i]; serial == "" || ev.SerialNumber == serial {
+			events = append(events, ev)
+		}
+	}
+
+	e.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(events); err != nil {
+		log.Warnln("Error writing events response:", err)
+	}
+}
+
+// transitionCollector exposes the tracked transitions and time spent per value
+// of the named statuses of all devices
+type transitionCollector struct {
+	e *exporter
+
+	transitions map[string]*prometheus.Desc
+	seconds     map[string]*prometheus.Desc
+}
+
+func newTransitionCollector(e *exporter, labels []string) *transitionCollector {
+	c := &transitionCollector{
+		e:           e,
+		transitions: map[string]*prometheus.Desc{},
+		seconds:     map[string]*prometheus.Desc{},
+	}
+
+	for _, k := range enumKinds {
+		c.transitions[k.Name] = prometheus.NewDesc(
+			prometheus.BuildFQName(Namespace, "", k.Name+"_transitions_total"),
+			"Number of transitions of the "+k.Description+" from one value to another",
+			append(slices.Clone(labels), LabelFrom, LabelTo), nil,
+		)
+
+		c.seconds[k.Name] = prometheus.NewDesc(
+			prometheus.BuildFQName(Namespace, "", k.Name+"_seconds_total"),
+			"Time spent in each "+k.Description+" in seconds, counted between samples",
+			append(slices.Clone(labels), k.Label), nil,
+		)
+	}
+
+	return c
+}
+
+func (c *transitionCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, k := range enumKinds {
+		ch <- c.transitions[k.Name]
+		ch <- c.seconds[k.Name]
+	}
+}
+
+func (c *transitionCollector) Collect(ch chan<- prometheus.Metric) {
+	c.e.mu.RLock()
+	defer c.e.mu.RUnlock()
+
+	for _, d := range c.e.Devices {
+		ds, ok := c.e.State.Devices[d.SerialNumber]
+		if !ok {
+			continue
+		}
+
+		for _, k := range enumKinds {
+			es, ok := ds.Enums[k.Name]
+			if !ok {
+				continue
+			}
+
+			for v, sec := range es.Seconds {
+				lv := append(slices.Clone(d.LabelValues), v)
+				ch <- prometheus.MustNewConstMetric(c.seconds[k.Name], prometheus.CounterValue, sec, lv...)
+			}
+
+			for from, tos := range es.Transitions {
+				for to, n := range tos {
+					lv := append(slices.Clone(d.LabelValues), from, to)
+					ch <- prometheus.MustNewConstMetric(c.transitions[k.Name], prometheus.CounterValue, n, lv...)
+				}
+			}
+		}
+	}
+}
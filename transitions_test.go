@@ -0,0 +1,90 @@
+package main
+
+import (
+	"maps"
+	"testing"
+	"time"
+)
+
+func TestEnumStateUpdate(t *testing.T) {
+	t0 := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	type step struct {
+		v          string
+		t          time.Time
+		updated    bool
+		transition bool
+	}
+
+	tests := []struct {
+		name        string
+		steps       []step
+		value       string
+		seconds     map[string]float64
+		transitions map[string]map[string]float64
+	}{
+		{
+			name:        "first sample",
+			steps:       []step{{"Line Mode", t0, true, false}},
+			value:       "Line Mode",
+			seconds:     map[string]float64{"Line Mode": 0},
+			transitions: map[string]map[string]float64{},
+		},
+		{
+			name:        "time is counted for the previous value",
+			steps:       []step{{"Line Mode", t0, true, false}, {"Line Mode", t0.Add(time.Minute), true, false}, {"Battery Mode", t0.Add(3 * time.Minute), true, true}},
+			value:       "Battery Mode",
+			seconds:     map[string]float64{"Line Mode": 180, "Battery Mode": 0},
+			transitions: map[string]map[string]float64{"Line Mode": {"Battery Mode": 1}},
+		},
+		{
+			name: "transitions are counted per pair",
+			steps: []step{
+				{"Line Mode", t0, true, false}, {"Battery Mode", t0.Add(time.Minute), true, true},
+				{"Line Mode", t0.Add(2 * time.Minute), true, true}, {"Battery Mode", t0.Add(3 * time.Minute), true, true},
+			},
+			value:       "Battery Mode",
+			seconds:     map[string]float64{"Line Mode": 120, "Battery Mode": 60},
+			transitions: map[string]map[string]float64{"Line Mode": {"Battery Mode": 2}, "Battery Mode": {"Line Mode": 1}},
+		},
+		{
+			name:        "old and repeated samples are ignored",
+			steps:       []step{{"Line Mode", t0, true, false}, {"Battery Mode", t0, false, false}, {"Battery Mode", t0.Add(-time.Minute), false, false}},
+			value:       "Line Mode",
+			seconds:     map[string]float64{"Line Mode": 0},
+			transitions: map[string]map[string]float64{},
+		},
+		{
+			name:        "gaps are not counted",
+			steps:       []step{{"Line Mode", t0, true, false}, {"Battery Mode", t0.Add(maxSampleGap + time.Second), true, true}},
+			value:       "Battery Mode",
+			seconds:     map[string]float64{"Line Mode": 0, "Battery Mode": 0},
+			transitions: map[string]map[string]float64{"Line Mode": {"Battery Mode": 1}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var es enumState
+
+			for i, s := range tt.steps {
+				updated, transition := es.update(s.v, s.t)
+				if updated != s.updated || transition != s.transition {
+					t.Errorf("step %d: update() = %v, %v, want %v, %v", i, updated, transition, s.updated, s.transition)
+				}
+			}
+
+			if es.Value != tt.value {
+				t.Errorf("value = %s, want %s", es.Value, tt.value)
+			}
+
+			if !maps.Equal(es.Seconds, tt.seconds) {
+				t.Errorf("seconds = %v, want %v", es.Seconds, tt.seconds)
+			}
+
+			if !maps.EqualFunc(es.Transitions, tt.transitions, maps.Equal) {
+				t.Errorf("transitions = %v, want %v", es.Transitions, tt.transitions)
+			}
+		})
+	}
+}
@@ -0,0 +1,390 @@
+"use strict";
+
+// Renders the readings of the exporter API. The latest work info and the history of the
+// last 24 hours are loaded on start and kept up to date from the event stream.
+
+const DAY = 24 * 60 * 60 * 1000;
+
+// Gaps between samples longer than this are not connected in the sparklines
+const MAX_GAP = 60 * 60 * 1000;
+
+// Samples older than this are shown as stale
+const STALE_AGE = 15 * 60;
+
+const SPARKLINES = [
+  { name: "PV power", unit: "W", value: (wi) => wi.total_pv_input_power, power: true },
+  { name: "Load", unit: "W", value: (wi) => wi.total_ac_output_active_power, power: true },
+  { name: "Battery power", unit: "W", value: batteryPower, power: true },
+  { name: "Battery", unit: "%", value: (wi) => wi.battery_capacity },
+  { name: "Grid voltage", unit: "V", value: (wi) => wi.grid_voltage },
+];
+
+const state = {
+  devices: [],
+  // Latest work info by serial number, with the time it was received
+  latest: {},
+  // Samples of the last 24 hours by serial number, oldest first
+  history: {},
+  selected: decodeURIComponent(location.hash.slice(1)),
+};
+
+const $ = (id) => document.getElementById(id);
+
+// Returns the battery power in watts, positive when charging and negative when discharging.
+function batteryPower(wi) {
+  return wi.battery_voltage * (wi.battery_chg_current - wi.battery_dischg_current);
+}
+
+// Returns true if the source is or includes the grid.
+function usesGrid(source) {
+  return /utility|grid|line/i.test(source || "");
+}
+
+function formatPower(w) {
+  if (Math.abs(w) >= 1000) {
+    return (w / 1000).toFixed(1) + " kW";
+  }
+
+  return Math.round(w) + " W";
+}
+
+function formatValue(v, def) {
+  return def.power ? formatPower(v) : Math.round(v * 10) / 10 + " " + def.unit;
+}
+
+function formatAge(sec) {
+  if (sec < 90) {
+    return Math.max(0, Math.round(sec)) + " s ago";
+  }
+
+  if (sec < 90 * 60) {
+    return Math.round(sec / 60) + " min ago";
+  }
+
+  if (sec < 48 * 60 * 60) {
+    return Math.round(sec / 3600) + " h ago";
+  }
+
+  return Math.round(sec / 86400) + " days ago";
+}
+
+// Returns the seconds since the latest work info of the device was sampled, or null.
+function age(serial) {
+  const l = state.latest[serial];
+  if (!l) {
+    return null;
+  }
+
+  return l.age_seconds + (Date.now() - l.received) / 1000;
+}
+
+// Returns the status of a device as text and class name.
+function status(d) {
+  const l = state.latest[d.serialno];
+
+  if (d.online === false) {
+    return ["offline", "bad"];
+  }
+
+  if (!l) {
+    return ["waiting", "unknown"];
+  }
+
+  if (l.workinfo.over_load) {
+    return ["overload", "bad"];
+  }
+
+  if (l.workinfo.line_loss || l.workinfo.line_loss2) {
+    return ["grid lost", "warn"];
+  }
+
+  if (age(d.serialno) > STALE_AGE) {
+    return ["stale", "warn"];
+  }
+
+  return ["ok", "ok"];
+}
+
+async function fetchJSON(url) {
+  const res = await fetch(url);
+  if (!res.ok) {
+    const err = new Error(url + ": HTTP " + res.status);
+    err.status = res.status;
+    throw err;
+  }
+
+  return res.json();
+}
+
+// Stores the latest work info and adds it to the history if it is newer than the last sample.
+function apply(wi) {
+  state.latest[wi.serialno] = Object.assign({ received: Date.now() }, wi);
+
+  const h = (state.history[wi.serialno] = state.history[wi.serialno] || []);
+  const t = Date.parse(wi.sampled);
+
+  if (!h.length || t > Date.parse(h[h.length - 1].sampled)) {
+    h.push({ sampled: wi.sampled, workinfo: wi.workinfo });
+  }
+
+  while (h.length && Date.parse(h[0].sampled) < Date.now() - DAY) {
+    h.shift();
+  }
+}
+
+async function loadDevices() {
+  state.devices = await fetchJSON("api/v1/devices");
+
+  if (!state.devices.some((d) => d.serialno === state.selected) && state.devices.length) {
+    state.selected = state.devices[0].serialno;
+  }
+
+  const select = $("device");
+  select.replaceChildren(
+    ...state.devices.map((d) => new Option(d.name ? d.name + " (" + d.serialno + ")" : d.serialno, d.serialno))
+  );
+  select.value = state.selected;
+  select.hidden = state.devices.length < 2;
+}
+
+async function loadWorkInfo(serial) {
+  try {
+    apply(await fetchJSON("api/v1/devices/" + encodeURIComponent(serial) + "/workinfo"));
+  } catch (err) {
+    // No work info was retrieved yet
+    if (err.status !== 404) {
+      throw err;
+    }
+  }
+}
+
+async function loadHistory(serial) {
+  state.history[serial] = await fetchJSON("api/v1/devices/" + encodeURIComponent(serial) + "/history?since=24h");
+}
+
+async function load() {
+  try {
+    await loadDevices();
+    await Promise.all(state.devices.map((d) => loadHistory(d.serialno).then(() => loadWorkInfo(d.serialno))));
+    $("message").hidden = true;
+  } catch (err) {
+    $("message").textContent = "Error loading data: " + err.message;
+    $("message").hidden = false;
+  }
+
+  render();
+}
+
+function setFlow(id, active, reverse) {
+  const line = $(id);
+  line.classList.toggle("active", active);
+  line.classList.toggle("reverse", active && reverse);
+}
+
+function renderOverview() {
+  const l = state.latest[state.selected];
+
+  $("overview").hidden = !l;
+  if (!l) {
+    return;
+  }
+
+  const wi = l.workinfo;
+  const bat = batteryPower(wi);
+  const gridUsed = !wi.line_loss && (usesGrid(wi.load_source) || usesGrid(wi.charge_source));
+
+  $("flow-pv").textContent = formatPower(wi.total_pv_input_power);
+  $("flow-load").textContent = formatPower(wi.total_ac_output_active_power);
+  $("flow-battery").textContent = formatPower(Math.abs(bat)) + (bat > 0 ? " in" : bat < 0 ? " out" : "");
+  $("flow-grid").textContent = wi.line_loss ? "lost" : Math.round(wi.grid_voltage) + " V";
+  $("flow-mode").textContent = wi.work_mode;
+
+  setFlow("line-pv", wi.total_pv_input_power > 0, false);
+  setFlow("line-load", wi.total_ac_output_active_power > 0, false);
+  setFlow("line-battery", bat !== 0, bat < 0);
+  setFlow("line-grid", gridUsed, false);
+  $("line-grid").classList.toggle("lost", !!wi.line_loss);
+
+  const capacity = Math.max(0, Math.min(100, wi.battery_capacity));
+  const gauge = $("gauge");
+  gauge.style.strokeDasharray = capacity + " 100";
+  gauge.classList.toggle("low", capacity < 20);
+  $("battery-capacity").textContent = Math.round(capacity) + " %";
+  $("battery-detail").textContent = wi.battery_voltage + " V, " + formatPower(bat) + (bat > 0 ? " charging" : bat < 0 ? " discharging" : "");
+
+  $("work-mode").textContent = wi.work_mode;
+  $("charge-source").textContent = wi.charge_source;
+  $("load-source").textContent = wi.load_source;
+  $("sample-age").textContent = formatAge(age(state.selected));
+}
+
+// Returns a sparkline of the values as SVG element, breaking the line at gaps.
+function sparkline(points, start, min, max) {
+  const ns = "http://www.w3.org/2000/svg";
+  const svg = document.createElementNS(ns, "svg");
+  svg.setAttribute("viewBox", "0 0 300 50");
+  svg.setAttribute("preserveAspectRatio", "none");
+
+  let segment = [];
+  const segments = [segment];
+
+  points.forEach((p, i) => {
+    if (i > 0 && p.t - points[i - 1].t > MAX_GAP) {
+      segment = [];
+      segments.push(segment);
+    }
+
+    const x = ((p.t - start) / DAY) * 300;
+    const y = 48 - ((p.v - min) / (max - min || 1)) * 46;
+    segment.push(x.toFixed(1) + "," + y.toFixed(1));
+  });
+
+  for (const s of segments) {
+    if (s.length === 1) {
+      // A single point is drawn as a short line
+      s.push(s[0]);
+    }
+
+    const line = document.createElementNS(ns, "polyline");
+    line.setAttribute("points", s.join(" "));
+    line.setAttribute("vector-effect", "non-scaling-stroke");
+    svg.appendChild(line);
+  }
+
+  return svg;
+}
+
+function renderSparklines() {
+  const h = (state.history[state.selected] || []).filter((s) => Date.parse(s.sampled) >= Date.now() - DAY);
+
+  $("sparklines").hidden = !h.length;
+  if (!h.length) {
+    return;
+  }
+
+  const start = Date.now() - DAY;
+
+  $("sparkline-list").replaceChildren(
+    ...SPARKLINES.map((def) => {
+      const points = h.map((s) => ({ t: Date.parse(s.sampled), v: def.value(s.workinfo) })).filter((p) => isFinite(p.v));
+      const values = points.map((p) => p.v);
+      const min = Math.min(...values);
+      const max = Math.max(...values);
+
+      const item = document.createElement("div");
+      item.className = "sparkline";
+
+      const title = document.createElement("div");
+      title.className = "sparkline-title";
+      title.textContent = def.name;
+
+      const current = document.createElement("span");
+      current.className = "sparkline-current";
+      current.textContent = values.length ? formatValue(values[values.length - 1], def) : "";
+      title.appendChild(current);
+
+      const range = document.createElement("div");
+      range.className = "sparkline-range";
+      range.textContent = values.length ? "min " + formatValue(min, def) + ", max " + formatValue(max, def) : "no data";
+
+      item.append(title, sparkline(points, start, min, max), range);
+
+      return item;
+    })
+  );
+}
+
+function renderDevices() {
+  $("devices").hidden = !state.devices.length;
+
+  $("device-rows").replaceChildren(
+    ...state.devices.map((d) => {
+      const l = state.latest[d.serialno];
+      const wi = l ? l.workinfo : null;
+      const [text, cls] = status(d);
+
+      const row = document.createElement("tr");
+      row.classList.toggle("selected", d.serialno === state.selected);
+      row.addEventListener("click", () => select(d.serialno));
+
+      const cells = [
+        d.name ? d.name + " (" + d.serialno + ")" : d.serialno,
+        text,
+        wi ? wi.work_mode : "",
+        wi ? Math.round(wi.battery_capacity) + " %" : "",
+        wi ? formatPower(wi.total_pv_input_power) : "",
+        wi ? formatPower(wi.total_ac_output_active_power) : "",
+        l ? formatAge(age(d.serialno)) : "",
+      ];
+
+      cells.forEach((c, i) => {
+        const td = document.createElement("td");
+        td.textContent = c;
+        if (i === 1) {
+          td.className = "status " + cls;
+        }
+        row.appendChild(td);
+      });
+
+      return row;
+    })
+  );
+}
+
+function render() {
+  renderOverview();
+  renderSparklines();
+  renderDevices();
+}
+
+function select(serial) {
+  state.selected = serial;
+  $("device").value = serial;
+  history.replaceState(null, "", "#" + encodeURIComponent(serial));
+  render();
+}
+
+function connect() {
+  const events = new EventSource("api/v1/stream");
+
+  events.addEventListener("workinfo", (e) => {
+    const wi = JSON.parse(e.data);
+
+    // Devices that appear on the stream are added by refreshing the list
+    if (!state.devices.some((d) => d.serialno === wi.serialno)) {
+      loadDevices().then(render);
+    }
+
+    apply(wi);
+    render();
+  });
+
+  events.addEventListener("open", () => {
+    $("message").hidden = true;
+  });
+
+  // The browser reconnects by itself
+  events.addEventListener("error", () => {
+    $("message").textContent = "Connection lost, reconnecting…";
+    $("message").hidden = false;
+  });
+}
+
+$("device").addEventListener("change", (e) => select(e.target.value));
+
+load().then(() => {
+  if (document.body.dataset.stream === "true") {
+    connect();
+  } else {
+    setInterval(() => Promise.all(state.devices.map((d) => loadWorkInfo(d.serialno))).then(render), 30 * 1000);
+  }
+});
+
+// The device list is refreshed for discovered and offline devices
+setInterval(() => loadDevices().then(render).catch(() => {}), 5 * 60 * 1000);
+
+// Sample ages are updated between new readings
+setInterval(() => {
+  renderOverview();
+  renderDevices();
+}, 1000);